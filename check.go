@@ -1,24 +1,74 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"github.com/samuel/go-gettext/gettext"
+	"html/template"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"path"
+	"strings"
+	"time"
 )
 
+// templates, static files and locales built into the binary, when it is
+// compiled with -tags embed
+var Embedded fs.FS
+
 func main() {
 
 	// command line args
 	logPath := flag.String("log", "", "path to log file; otherwise stdout")
 	pidPath := flag.String("pid", "./check.pid", "path to create pid")
-	basePath := flag.String("base", "./", "path to base dir")
+	basePath := flag.String("base", "./", "path to base dir; defaults to the embedded files when built with them")
 	port := flag.Int("port", 8000, "port to listen on")
+	tbbPath := flag.String("tbbua", "", "path to extra Tor Browser user agent patterns, one per line")
+	scannerPath := flag.String("scannerua", "", "path to extra crawler and scanner user agent patterns, one per line")
+	perPort := flag.Bool("perport", false, "only count exits whose policy allows -exitip:-exitport, rather than the default target")
+	exitIP := flag.String("exitip", DefaultTarget.Address, "address exits must reach, with -perport")
+	exitPort := flag.Int("exitport", 0, "port exits must reach, with -perport; defaults to -port")
+	exitListPath := flag.String("exitlist", "", "path to a bulk exit list, one address a line, to consult for exits the policies don't have")
+	exitListURL := flag.String("exitlisturl", "", "where to fetch the bulk exit list from, e.g. https://check.torproject.org/torbulkexitlist; kept in -exitlist if set")
+	exitListInterval := flag.Duration("exitlistinterval", time.Hour, "how often to fetch -exitlisturl")
+	exitListTimeout := flag.Duration("exitlisttimeout", 10*time.Second, "how long to wait for -exitlisturl")
+	flag.BoolVar(&ShowTBBInfo, "tbbinfo", false, "explain Tor Browser to visitors who aren't using Tor")
+	flag.StringVar(&DownloadURL, "download", DownloadURL, "where -tbbinfo sends people to get Tor Browser")
+	flag.BoolVar(&HideTBBMessaging, "hidetbb", false, "don't tell Tor users whether their user agent looks like Tor Browser")
+	trusted := flag.String("trusted", "127.0.0.0/8,::1", "comma separated proxies allowed to set X-Forwarded-For; empty to ignore it from everyone")
+	redact := flag.String("redactip", "none", "how much of the client address to show: none, partial or full")
+	localeTTL := flag.Duration("localettl", DefaultLocaleTTL, "how long to keep the installed locale list before rescanning")
+	flag.Float64Var(&MinCoverage, "mincoverage", MinCoverage, "fraction of check.pot a locale must translate to be offered")
+	flag.StringVar(&ContentSecurityPolicy, "csp", ContentSecurityPolicy, "Content-Security-Policy sent with every response; empty to leave it out")
+	rate := flag.Float64("ratelimit", 0, "requests a second each client may make on average; 0 for no limit")
+	burst := flag.Int("burst", 20, "requests a client may make at once, with -ratelimit")
+	langsURL := flag.String("langsurl", "", "where to fetch the language list from, e.g. https://www.transifex.com/api/2/languages/; data/langs is used as-is if empty")
+	langsTimeout := flag.Duration("langstimeout", 10*time.Second, "how long to wait for -langsurl")
+	metrics := flag.Bool("metrics", false, "serve Prometheus metrics on /metrics")
+	dev := flag.Bool("dev", false, "re-read templates from disk on every request")
+	flag.BoolVar(&Debug, "debug", false, "log at debug level and send an X-Template header naming the template behind each page")
 	flag.Parse()
 
+	if Debug {
+		Log = StdLogger{Min: LevelDebug}
+	}
+
+	// serve from disk unless we have embedded files and weren't
+	// pointed elsewhere
+	config := NewConfig(*basePath)
+	if Embedded != nil {
+		config.Files = Embedded
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "base" {
+				config.Files = os.DirFS(*basePath)
+			}
+		})
+	}
+	config.DevMode = *dev
+	config.LocaleTTL = *localeTTL
+	files := config.Files
+
 	// log to file
 	if len(*logPath) > 0 {
 		f, err := os.Create(*logPath)
@@ -40,33 +90,147 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// extra user agents to treat as Tor Browser
+	if len(*tbbPath) > 0 {
+		f, err := os.Open(*tbbPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ExtraTBBUserAgents, err = LoadUserAgents(f); err != nil {
+			log.Fatal(err)
+		}
+		f.Close()
+	}
+
+	// extra user agents to flag as scanners
+	if len(*scannerPath) > 0 {
+		f, err := os.Open(*scannerPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		patterns, err := LoadUserAgents(f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ScannerUserAgents = append(ScannerUserAgents, patterns...)
+		f.Close()
+	}
+
+	if TrustedProxies, err = ParseCIDRs(strings.Split(*trusted, ",")); err != nil {
+		log.Fatal(err)
+	}
+
+	if IPRedaction, err = ParseRedaction(*redact); err != nil {
+		log.Fatal(err)
+	}
+
 	// load i18n
-	domain, err := gettext.NewDomain("check", path.Join(*basePath, "locale"))
+	domain, err := NewDomain(files, "check")
 	if err != nil {
-		log.Fatal(err)
+		Log.Warnf("Failed to load translations, serving English: %v", err)
+		domain = NullDomain()
+	}
+	if len(*langsURL) > 0 {
+		// fetch once before the first scan; afterwards it only rewrites
+		// data/langs for the next one, which is read from disk even in an
+		// embedded build
+		config.PreferDisk("data/langs")
+		files = config.Files
+		langsPath := config.Path("data/langs")
+		ctx, cancel := context.WithTimeout(context.Background(), *langsTimeout)
+		FetchRemoteLocales(ctx, *langsURL, langsPath, files)
+		cancel()
+		go func() {
+			time.Sleep(*localeTTL)
+			RefreshLocales(*langsURL, *langsTimeout, *localeTTL, langsPath, files)
+		}()
 	}
-	Locales := GetLocaleList(*basePath)
+	Locales := config.Locales()
+	Locales.Refresh()
+
+	// what /readyz waits for
+	ready := new(Readiness)
+	ready.Require("templates", config.TemplatesOK)
+	ready.Require("locales", Locales.Loaded)
 
 	// Load Tor exits and listen for SIGUSR2 to reload
 	exits := new(Exits)
-	exits.Run(path.Join(*basePath, "data/exit-policies"))
+	if *perPort {
+		// The bulk list answers for whatever ip and port it is asked
+		// about, but the check itself assumes the exit can reach us on
+		// 443. Behind a nonstandard port that includes exits which would
+		// refuse to relay to this service.
+		exits.Target = AddressPort{*exitIP, *exitPort}
+		if exits.Target.Port == 0 {
+			exits.Target.Port = *port
+		}
+	}
+	exits.Run(config.Path("data/exit-policies"))
+	if len(*exitListPath) > 0 || len(*exitListURL) > 0 {
+		exits.Bulk = NewExitList(ExitListFile(*exitListPath))
+		if len(*exitListPath) > 0 {
+			if err := exits.Bulk.Refresh(context.Background()); err != nil {
+				Log.Warnf("Loading the exit list: %v", err)
+			}
+		}
+		if len(*exitListURL) > 0 {
+			exits.Bulk.Source = ExitListURL(*exitListURL)
+			exits.Bulk.Cache = *exitListPath
+			ctx, cancel := context.WithTimeout(context.Background(), *exitListTimeout)
+			if err := exits.Bulk.Refresh(ctx); err != nil {
+				Log.Warnf("Fetching %s: %v", *exitListURL, err)
+			}
+			cancel()
+			go exits.Bulk.Run(*exitListTimeout, *exitListInterval)
+		}
+		Log.Infof("Bulk exit list has %d exits.", exits.Bulk.Len())
+	}
 
 	// files
-	files := http.FileServer(http.Dir(path.Join(*basePath, "public")))
+	public, err := fs.Sub(files, "public")
+	if err != nil {
+		log.Fatal(err)
+	}
+	static := http.FileServer(http.FS(public))
 	Phttp := http.NewServeMux()
-	Phttp.Handle("/torcheck/", http.StripPrefix("/torcheck/", files))
-	Phttp.Handle("/", files)
+	Phttp.Handle("/torcheck/", http.StripPrefix("/torcheck/", static))
+	Phttp.Handle("/", static)
 
-	// routes
-	http.HandleFunc("/", RootHandler(CompileTemplate(*basePath, domain, "index.html"), exits, domain, Phttp, Locales))
-	bulk := BulkHandler(CompileTemplate(*basePath, domain, "bulk.html"), exits, domain)
-	http.HandleFunc("/torbulkexitlist", bulk)
-	http.HandleFunc("/cgi-bin/TorBulkExitList.py", bulk)
-	http.HandleFunc("/api/bulk", bulk)
-	http.HandleFunc("/api/ip", APIHandler(exits))
+	// routes; only a broken base layout stops us here, a broken page
+	// just serves the fallback
+	root, err := config.Templated(domain, "index.html", func(l *template.Template) http.HandlerFunc {
+		return RootHandler(l, exits, domain, Phttp, Locales)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	bulk, err := config.Templated(domain, "bulk.html", func(l *template.Template) http.HandlerFunc {
+		return BulkHandler(l, exits, domain)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	api := APIHandler(exits)
+	if *rate > 0 {
+		limiter := NewRateLimiter(*rate, *burst)
+		root = limiter.LimitChecks(domain, Locales, root)
+		bulk = limiter.Limit(domain, Locales, bulk)
+		api = limiter.Limit(domain, Locales, api)
+	}
+	http.HandleFunc("/", MethodGuard(PageMethods, root))
+	http.HandleFunc("/torbulkexitlist", MethodGuard(PageMethods, bulk))
+	http.HandleFunc("/cgi-bin/TorBulkExitList.py", MethodGuard(PageMethods, bulk))
+	http.HandleFunc("/api/bulk", MethodGuard(APIMethods, bulk))
+	http.HandleFunc("/api/ip", MethodGuard(APIMethods, api))
+	http.HandleFunc("/api/locales", MethodGuard(APIMethods, LocalesHandler(Locales)))
+	http.HandleFunc("/healthz", MethodGuard(PageMethods, HealthHandler))
+	http.HandleFunc("/readyz", MethodGuard(PageMethods, ReadyHandler(ready)))
+	if *metrics {
+		http.HandleFunc("/metrics", MethodGuard(PageMethods, MetricsHandler(Stats, exits)))
+	}
 
 	// start the server
-	log.Printf("Listening on port: %d\n", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	Log.Infof("Listening on port: %d", *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), SecurityHeaders(Gzip(http.DefaultServeMux))))
 
 }
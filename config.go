@@ -0,0 +1,118 @@
+package main
+
+import (
+	"html/template"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// the templates every page is parsed on top of, under public/
+var DefaultLayoutFiles = []string{"base.html", "torbutton.html"}
+
+// Config is where the server finds its files and how it treats them.
+// Each Config caches its own base layout, so two can serve from different
+// directories in one process.
+type Config struct {
+	// the directory data/exit-policies and data/langs are written to
+	Base string
+	// templates, static files and locales; os.DirFS(Base) unless the
+	// binary brings its own
+	Files fs.FS
+	// parsed into the base layout, relative to public/
+	LayoutFiles []string
+	// re-parse every template on each use instead of caching the layout
+	DevMode bool
+	// how long the installed locale list is kept before rescanning
+	LocaleTTL time.Duration
+
+	layoutOnce sync.Once
+	layout     *template.Template
+	layoutErr  error
+
+	localesOnce sync.Once
+	locales     *LocaleCache
+
+	// the last CompileTemplate error for each page Templated serves
+	templatesMu sync.Mutex
+	templates   map[string]error
+}
+
+func NewConfig(base string) *Config {
+	return &Config{
+		Base:        base,
+		Files:       os.DirFS(base),
+		LayoutFiles: DefaultLayoutFiles,
+		LocaleTTL:   DefaultLocaleTTL,
+	}
+}
+
+// NewConfigFS is NewConfig for files that aren't in a directory, like the
+// embedded ones.
+func NewConfigFS(fsys fs.FS) *Config {
+	c := NewConfig(".")
+	c.Files = fsys
+	return c
+}
+
+// Path is name, a slash separated path under Base, on disk.
+func (c *Config) Path(name string) string {
+	return path.Join(c.Base, name)
+}
+
+// PreferDisk makes name, a slash separated path under Base, come from
+// disk whenever it is there, even when the rest of Files is
+// embedded. It is for files the server rewrites while running, like
+// data/langs with -langsurl. Call it before Locales.
+func (c *Config) PreferDisk(name string) {
+	c.Files = overlayFS{c.Files, name, c.Path(name)}
+}
+
+// overlayFS serves name from path on disk when it exists, and everything
+// else from FS.
+type overlayFS struct {
+	fs.FS
+	name string
+	path string
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if name == o.name {
+		if f, err := os.Open(o.path); err == nil {
+			return f, nil
+		}
+	}
+	return o.FS.Open(name)
+}
+
+// Locales is the installed locale list for c.Files, created on first use.
+func (c *Config) Locales() *LocaleCache {
+	c.localesOnce.Do(func() {
+		c.locales = NewLocaleCache(c.Files, c.LocaleTTL)
+	})
+	return c.locales
+}
+
+// TemplatesOK reports whether Templated has been given a page and every
+// page it serves last compiled without an error.
+func (c *Config) TemplatesOK() bool {
+	c.templatesMu.Lock()
+	defer c.templatesMu.Unlock()
+	for _, err := range c.templates {
+		if err != nil {
+			return false
+		}
+	}
+	return len(c.templates) > 0
+}
+
+func (c *Config) noteTemplate(templateName string, err error) {
+	c.templatesMu.Lock()
+	defer c.templatesMu.Unlock()
+	if c.templates == nil {
+		c.templates = make(map[string]error)
+	}
+	c.templates[templateName] = err
+}
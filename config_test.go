@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestNewConfig(t *testing.T) {
+	c := NewConfig("/srv/check")
+	if c.Path("data/langs") != "/srv/check/data/langs" {
+		t.Errorf("Unexpected path %q", c.Path("data/langs"))
+	}
+	if c.DevMode || c.LocaleTTL != DefaultLocaleTTL || len(c.LayoutFiles) != len(DefaultLayoutFiles) {
+		t.Errorf("Unexpected defaults %+v", c)
+	}
+	if c.Locales() != c.Locales() {
+		t.Error("Expected one locale cache per Config")
+	}
+	if NewConfigFS(testFiles).Locales() == c.Locales() {
+		t.Error("Expected each Config to have its own locale cache")
+	}
+}
+
+func TestConfigsDontShareLayout(t *testing.T) {
+	render := func(c *Config) string {
+		l, err := c.CompileTemplate(NullDomain(), "index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := l.ExecuteTemplate(buf, "index.html", Page{IP: "1.2.3.4"}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	other := fstest.MapFS{}
+	for k, v := range testFiles {
+		other[k] = v
+	}
+	other["public/base.html"] = &fstest.MapFile{Data: []byte(`{{ define "base.html" }}<h1>{{ template "title" . }}</h1>{{ end }}`)}
+
+	dirA, dirB := writeFiles(t, testFiles), writeFiles(t, other)
+	a, b := NewConfig(dirA), NewConfig(dirB)
+	if got := render(a); got != "<title>1.2.3.4</title>" {
+		t.Errorf("Unexpected render from %s: %q", dirA, got)
+	}
+	if got := render(b); got != "<h1>1.2.3.4</h1>" {
+		t.Errorf("Unexpected render from %s: %q", dirB, got)
+	}
+
+	// editing one directory leaves both cached layouts alone
+	edited := []byte(`{{ define "base.html" }}<p>{{ template "title" . }}</p>{{ end }}`)
+	if err := os.WriteFile(filepath.Join(dirA, "public", "base.html"), edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := render(a); got != "<title>1.2.3.4</title>" {
+		t.Errorf("Expected the cached layout, got %q", got)
+	}
+	if got := render(b); got != "<h1>1.2.3.4</h1>" {
+		t.Errorf("Expected the other Config's layout, got %q", got)
+	}
+	if got := render(NewConfig(dirA)); got != "<p>1.2.3.4</p>" {
+		t.Errorf("Expected a new Config to parse the edited layout, got %q", got)
+	}
+}
+
+func TestPreferDisk(t *testing.T) {
+	recordLogs(t)
+	embedded := fstest.MapFS{"locale/fr/torcheck.po": {Data: []byte{}}}
+	for k, v := range testFiles {
+		embedded[k] = v
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"code": "de", "name": "German"}, {"code": "fr", "name": "French"}]`)
+	}))
+	defer server.Close()
+
+	// an embedded build started from a directory with no data/ at all
+	c := NewConfig(t.TempDir())
+	c.Files = embedded
+	c.PreferDisk("data/langs")
+	if _, ok := c.Locales().Refresh()["fr"]; ok {
+		t.Fatal("Expected only the embedded language list before fetching")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := FetchRemoteLocales(ctx, server.URL, c.Path("data/langs"), c.Files); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Locales().Refresh()["fr"]; !ok {
+		t.Error("Expected the fetched language list to reach the locale scan")
+	}
+	if _, err := os.Stat(c.Path("data/langs")); err != nil {
+		t.Errorf("Expected the fetched list on disk: %v", err)
+	}
+}
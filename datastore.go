@@ -126,6 +126,12 @@ type Exits struct {
 	UpdateTime  time.Time
 	ReloadChan  chan os.Signal
 	IsTorLookup map[string]string
+	// what an exit must be able to reach to count in IsTor; the zero
+	// value means DefaultTarget
+	Target AddressPort
+	// the bulk exit list, for exits the policies don't have yet; set
+	// with -exitlist
+	Bulk *ExitList
 }
 
 func (e *Exits) Dump(w io.Writer, tminus int, ip string, port int) {
@@ -165,15 +171,21 @@ func (e *Exits) GetAllExits(ap AddressPort, tminus int, fn func(string, string,
 var DefaultTarget = AddressPort{"38.229.72.22", 443}
 
 func (e *Exits) PreComputeTorList() {
+	target := e.Target
+	if target == (AddressPort{}) {
+		target = DefaultTarget
+	}
 	newmap := make(map[string]string)
-	e.GetAllExits(DefaultTarget, 16, func(ip string, fingerprint string, _ int) {
+	e.GetAllExits(target, 16, func(ip string, fingerprint string, _ int) {
 		newmap[ip] = fingerprint
 	})
 	e.IsTorLookup = newmap
 }
 
 func (e *Exits) IsTor(remoteAddr string) (fingerprint string, ok bool) {
-	fingerprint, ok = e.IsTorLookup[remoteAddr]
+	if fingerprint, ok = e.IsTorLookup[remoteAddr]; !ok {
+		ok = e.Bulk.IsTorExit(remoteAddr)
+	}
 	return
 }
 
@@ -271,7 +283,7 @@ func (e *Exits) Run(filePath string) {
 		for {
 			<-e.ReloadChan
 			e.LoadFromFile(filePath, true)
-			log.Println("Exit list updated.")
+			Log.Infof("Exit list updated.")
 		}
 	}()
 	e.LoadFromFile(filePath, false)
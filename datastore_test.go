@@ -55,6 +55,9 @@ func (e *Exits) assertIsTor(t *testing.T, ip string, expected bool) {
 	}
 }
 
+// a single exit, 91.121.43.80, that only allows 443
+const testExit = `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["91.121.43.80"], "Fingerprint": "1"}`
+
 func setupExitList(t *testing.T, testData string) (e *Exits) {
 	e = new(Exits)
 	err := e.Load(strings.NewReader(testData), false)
@@ -181,6 +184,41 @@ func TestPastHours(t *testing.T) {
 	expectDump(t, exits, "123.123.123.123", 80, "111.111.111.111")
 }
 
+func TestRemovedExitRetained(t *testing.T) {
+	both := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}
+	{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["222.222.222.222"], "Fingerprint": "2"}`
+	one := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}`
+	exits := setupExitList(t, both)
+
+	// an exit dropped from the latest list keeps counting as Tor for
+	// the 16 hours the lookup covers, so a refresh doesn't flip users
+	for i := 1; i <= 16; i++ {
+		if err := exits.Load(strings.NewReader(one), true); err != nil {
+			t.Fatal(err)
+		}
+		exits.assertIsTor(t, "222.222.222.222", true)
+	}
+	if err := exits.Load(strings.NewReader(one), true); err != nil {
+		t.Fatal(err)
+	}
+	exits.assertIsTor(t, "222.222.222.222", false)
+	exits.assertIsTor(t, "111.111.111.111", true)
+}
+
+func TestTarget(t *testing.T) {
+	testData := `{"Rules": [{"IsAccept": true, "MinPort": 443, "MaxPort": 443, "Address": null, "IsAddressWildcard": true}], "IsAllowedDefault": false, "Address": ["111.111.111.111"], "Fingerprint": "1"}
+	{"Rules": [{"IsAccept": true, "MinPort": 8000, "MaxPort": 8000, "Address": "38.229.72.22"}], "IsAllowedDefault": false, "Address": ["222.222.222.222"], "Fingerprint": "2"}`
+	exits := setupExitList(t, testData)
+	// by default exits need to reach DefaultTarget
+	exits.assertIsTor(t, "111.111.111.111", true)
+	exits.assertIsTor(t, "222.222.222.222", false)
+
+	exits.Target = AddressPort{DefaultTarget.Address, 8000}
+	exits.PreComputeTorList()
+	exits.assertIsTor(t, "111.111.111.111", false)
+	exits.assertIsTor(t, "222.222.222.222", true)
+}
+
 func BenchmarkIsTor(b *testing.B) {
 	e := new(Exits)
 	e.LoadFromFile("data/exit-policies", false)
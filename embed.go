@@ -0,0 +1,15 @@
+//go:build embed
+// +build embed
+
+package main
+
+import "embed"
+
+// run `make i18n` first so the locales and language list exist
+//
+//go:embed public locale data/langs data/locale-names.json check.pot
+var embedded embed.FS
+
+func init() {
+	Embedded = embedded
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExitListSource opens the latest bulk exit list, giving up when ctx is
+// done.
+type ExitListSource func(ctx context.Context) (io.ReadCloser, error)
+
+// ExitListFile reads the list from a file on disk.
+func ExitListFile(name string) ExitListSource {
+	return func(context.Context) (io.ReadCloser, error) {
+		return os.Open(name)
+	}
+}
+
+// ExitListURL fetches the list over HTTP, e.g. from
+// https://check.torproject.org/torbulkexitlist
+func ExitListURL(url string) ExitListSource {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+		return resp.Body, nil
+	}
+}
+
+// the bulk list is a few thousand lines; anything this big is wrong
+const maxExitListSize = 8 << 20
+
+// ExitList is the bulk exit list, one address a line, indexed for lookup.
+// It answers for exits that data/exit-policies doesn't know about yet.
+type ExitList struct {
+	Source ExitListSource
+	// where a successful Refresh keeps a copy, e.g. for the next start;
+	// empty to keep nothing
+	Cache string
+
+	mu    sync.RWMutex
+	addrs map[string]bool
+}
+
+func NewExitList(source ExitListSource) *ExitList {
+	return &ExitList{Source: source}
+}
+
+// IsTorExit reports whether ip, in any form CanonicalIP accepts, is on
+// the list. A nil list has no exits.
+func (l *ExitList) IsTorExit(ip string) bool {
+	if l == nil {
+		return false
+	}
+	addr, err := CanonicalIP(ip)
+	if err != nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.addrs[addr]
+}
+
+func (l *ExitList) Len() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.addrs)
+}
+
+// Refresh replaces the list with what Source returns. On any error the
+// current list is kept.
+func (l *ExitList) Refresh(ctx context.Context) error {
+	rc, err := l.Source(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	body, err := io.ReadAll(io.LimitReader(rc, maxExitListSize))
+	if err != nil {
+		return err
+	}
+	addrs, err := ParseExitList(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no exits listed")
+	}
+	l.mu.Lock()
+	l.addrs = addrs
+	l.mu.Unlock()
+	if len(l.Cache) > 0 {
+		if err = writeAtomic(l.Cache, body); err != nil {
+			Log.Warnf("Caching the exit list: %v", err)
+		}
+	}
+	return nil
+}
+
+// Run refreshes the list every interval, each attempt bounded by
+// timeout, apart from the requests reading it.
+func (l *ExitList) Run(timeout time.Duration, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := l.Refresh(ctx); err != nil {
+			Log.Warnf("Refreshing the exit list, keeping %d exits: %v", l.Len(), err)
+		} else {
+			Log.Infof("Exit list refreshed, %d exits.", l.Len())
+		}
+		cancel()
+	}
+}
+
+// ParseExitList reads one IPv4 or IPv6 address a line. Blank lines and
+// comments starting with # are skipped, as are lines that aren't an
+// address, with a warning.
+func ParseExitList(source io.Reader) (map[string]bool, error) {
+	addrs := make(map[string]bool)
+	scanner := bufio.NewScanner(source)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		addr, err := CanonicalIP(line)
+		if err != nil {
+			Log.Warnf("Exit list line %d: %v", n, err)
+			continue
+		}
+		addrs[addr] = true
+	}
+	return addrs, scanner.Err()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBulkList = `# torbulkexitlist
+185.220.101.1
+2001:db8::1 # an IPv6 exit
+not-an-address
+
+2001:0DB8:0000::0002
+`
+
+func stringSource(list string) ExitListSource {
+	return func(context.Context) (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(list)), nil
+	}
+}
+
+func TestExitList(t *testing.T) {
+	logs := recordLogs(t)
+	l := NewExitList(stringSource(testBulkList))
+	if err := l.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 3 {
+		t.Errorf("Expected 3 exits, got %d", l.Len())
+	}
+	for ip, expected := range map[string]bool{
+		"185.220.101.1":        true,
+		"185.220.101.1:443":    true,
+		"::ffff:185.220.101.1": true,
+		"2001:db8::1":          true,
+		"[2001:DB8::2]:9000":   true,
+		"185.220.101.2":        false,
+		"2001:db8::3":          false,
+		"not-an-address":       false,
+		"":                     false,
+	} {
+		if got := l.IsTorExit(ip); got != expected {
+			t.Errorf("IsTorExit(%q): expected %t, got %t", ip, expected, got)
+		}
+	}
+	if !logs.has("warn: Exit list line 4:") {
+		t.Errorf("Expected a warning for the malformed line, got %q", logs.entries)
+	}
+
+	var none *ExitList
+	if none.IsTorExit("185.220.101.1") || none.Len() != 0 {
+		t.Error("Expected a nil list to have no exits")
+	}
+}
+
+func TestExitListRefresh(t *testing.T) {
+	recordLogs(t)
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, "185.220.101.1\n")
+	}))
+	defer ts.Close()
+
+	cache := filepath.Join(t.TempDir(), "torbulkexitlist")
+	l := NewExitList(ExitListURL(ts.URL))
+	l.Cache = cache
+	if err := l.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(cache); err != nil || string(b) != "185.220.101.1\n" {
+		t.Errorf("Expected the list cached, got %q, %v", b, err)
+	}
+
+	// a later copy on disk loads the same way
+	disk := NewExitList(ExitListFile(cache))
+	if err := disk.Refresh(context.Background()); err != nil || !disk.IsTorExit("185.220.101.1") {
+		t.Errorf("Expected the cached list to load, got %v", err)
+	}
+
+	// failures keep what we had
+	status = http.StatusInternalServerError
+	if err := l.Refresh(context.Background()); err == nil {
+		t.Error("Expected a server error to fail the refresh")
+	}
+	l.Source = stringSource("# nothing\n")
+	if err := l.Refresh(context.Background()); err == nil {
+		t.Error("Expected an empty list to fail the refresh")
+	}
+	if !l.IsTorExit("185.220.101.1") {
+		t.Error("Expected a failed refresh to keep the old list")
+	}
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	l.Source = ExitListURL(slow.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Refresh(ctx); err == nil {
+		t.Error("Expected the deadline to fail the refresh")
+	}
+}
+
+func TestBulkExitsInCheck(t *testing.T) {
+	exits := setupExitList(t, testExit)
+	exits.Bulk = NewExitList(stringSource(testBulkList))
+	if err := exits.Bulk.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for addr, expected := range map[string]bool{
+		"91.121.43.80:1234":  true,
+		"185.220.101.1:1234": true,
+		"[2001:db8::1]:1234": true,
+		"185.220.101.2:1234": false,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		if res := CheckRequest(r, exits); res.IsTor != expected {
+			t.Errorf("%s: expected IsTor %t, got %+v", addr, expected, res)
+		}
+	}
+}
@@ -1,5 +1,5 @@
 module git.torproject.org/check.git
 
-go 1.11
+go 1.16
 
 require github.com/samuel/go-gettext v0.0.0-20171108220917-e1966bdd77f4
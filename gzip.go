@@ -0,0 +1,143 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responses shorter than this aren't worth the gzip header and trailer
+var GzipMinSize = 1024
+
+// content types that are already compressed
+var precompressed = []string{"image/", "video/", "audio/", "font/woff", "application/zip", "application/gzip", "application/x-gzip"}
+
+// Gzip compresses responses for clients that accept it. The Content-Type
+// is settled, by sniffing if need be, before anything is compressed.
+func Gzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || len(r.Header.Get("Range")) > 0 || !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != "gzip" {
+			continue
+		}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter holds the start of the body until it knows whether to
+// compress it.
+type gzipWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if !g.decided {
+		g.buf = append(g.buf, p...)
+		if len(g.buf) < GzipMinSize {
+			return len(p), nil
+		}
+		if err := g.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+func (g *gzipWriter) decide() error {
+	g.decided = true
+	header := g.Header()
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if len(header.Get("Content-Type")) == 0 && len(g.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	// what this client gets may be compressed, so it isn't byte for byte
+	// what a strong ETag promises, and 304s have to say the same
+	if etag := header.Get("ETag"); len(etag) > 0 && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	if len(g.buf) >= GzipMinSize && g.compressible() {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		g.ResponseWriter.WriteHeader(g.status)
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+		_, err := g.gz.Write(g.buf)
+		return err
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	_, err := g.ResponseWriter.Write(g.buf)
+	return err
+}
+
+func (g *gzipWriter) compressible() bool {
+	switch g.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if len(g.Header().Get("Content-Encoding")) > 0 {
+		return false
+	}
+	ct := g.Header().Get("Content-Type")
+	if strings.HasPrefix(ct, "image/svg") {
+		return true
+	}
+	for _, prefix := range precompressed {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Close sends whatever is still held back and finishes the gzip stream.
+func (g *gzipWriter) Close() error {
+	if !g.decided {
+		if err := g.decide(); err != nil {
+			return err
+		}
+	}
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
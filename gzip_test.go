@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipGet(h http.Handler, target string, encoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	if len(encoding) > 0 {
+		r.Header.Set("Accept-Encoding", encoding)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	body := strings.Repeat("<p>Congratulations. This browser is configured to use Tor.</p>\n", 64)
+	layout := template.Must(template.New("").Parse(`{{ define "index.html" }}` + body + `{{ end }}`))
+	exits := setupExitList(t, testExit)
+	h := SecurityHeaders(Gzip(MethodGuard(PageMethods, RootHandler(layout, exits, testDomain, http.NewServeMux(), nil))))
+
+	w := gzipGet(h, "/", "deflate, gzip;q=0.8")
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Expected a gzipped response, got Content-Encoding %q", ce)
+	}
+	if v := w.Header().Get("Vary"); v != "Accept-Encoding" {
+		t.Errorf("Expected Vary: Accept-Encoding, got %q", v)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Expected the page's own Content-Type, got %q", ct)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("Expected the security headers to survive compression")
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Errorf("Decompressed body doesn't match:\n%q", got)
+	}
+
+	for _, encoding := range []string{"", "identity", "gzip;q=0"} {
+		w = gzipGet(h, "/", encoding)
+		if ce := w.Header().Get("Content-Encoding"); ce != "" || w.Body.String() != body {
+			t.Errorf("Accept-Encoding %q: expected an uncompressed page, got Content-Encoding %q", encoding, ce)
+		}
+	}
+}
+
+func TestGzipSkips(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 2048)...)
+	cases := map[string]http.HandlerFunc{
+		"tiny": func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "Sorry. You are not using Tor.\n")
+		},
+		"sniffed image": func(w http.ResponseWriter, r *http.Request) {
+			w.Write(png)
+		},
+		"already encoded": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(bytes.Repeat([]byte("x"), 2048))
+		},
+		"not modified": func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotModified)
+		},
+	}
+	for name, h := range cases {
+		plain := gzipGet(h, "/", "")
+		w := gzipGet(Gzip(h), "/", "gzip")
+		if w.Code != plain.Code || !bytes.Equal(w.Body.Bytes(), plain.Body.Bytes()) {
+			t.Errorf("%s: expected the response to pass through, got %d %q", name, w.Code, w.Body.String())
+		}
+		if name != "already encoded" && w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: didn't expect Content-Encoding, got %q", name, w.Header().Get("Content-Encoding"))
+		}
+		if ct := w.Header().Get("Content-Type"); ct != plain.Header().Get("Content-Type") {
+			t.Errorf("%s: Content-Type %q, expected %q", name, ct, plain.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestGzipETag(t *testing.T) {
+	body := strings.Repeat("{}", GzipMinSize)
+	h := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		if NoneMatch(r, `"abc"`) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, body)
+	}))
+
+	if w := gzipGet(h, "/", ""); w.Header().Get("ETag") != `"abc"` {
+		t.Errorf("Expected the strong ETag uncompressed, got %q", w.Header().Get("ETag"))
+	}
+	w := gzipGet(h, "/", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("ETag") != `W/"abc"` {
+		t.Errorf("Expected a weak ETag when compressing, got %q", w.Header().Get("ETag"))
+	}
+
+	// revalidating the compressed copy answers with the same validator
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified || w.Header().Get("ETag") != `W/"abc"` {
+		t.Errorf("Expected a 304 with the weak ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
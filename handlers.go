@@ -3,18 +3,127 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/samuel/go-gettext/gettext"
 	"html/template"
 	"io"
-	"log"
+	"math"
+	"mime"
 	"net"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// methods answered by each kind of route
+var (
+	PageMethods = []string{"GET", "HEAD", "OPTIONS"}
+	APIMethods  = []string{"GET", "HEAD", "OPTIONS", "POST"}
+)
+
+// MethodGuard answers OPTIONS itself and rejects anything not in allowed
+// with a 405, so both advertise the same Allow header.
+func MethodGuard(allowed []string, h http.HandlerFunc) http.HandlerFunc {
+	allow := strings.Join(allowed, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range allowed {
+			if r.Method != m {
+				continue
+			}
+			if m == "OPTIONS" {
+				w.Header().Set("Allow", allow)
+				w.Header().Set("Content-Length", "0")
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			h(w, r)
+			return
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// sent with every response; -csp replaces ContentSecurityPolicy. Styles
+// allow 'unsafe-inline' because each page sets its own in a <style> block.
+var (
+	ContentSecurityPolicy = "default-src 'none'; style-src 'self' 'unsafe-inline'; img-src 'self'; script-src 'self'; font-src 'self'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"
+	PermissionsPolicy     = "accelerometer=(), camera=(), geolocation=(), gyroscope=(), magnetometer=(), microphone=(), payment=(), usb=()"
+)
+
+// SecurityHeaders sets the headers we want on every response before
+// handing off to h.
+func SecurityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		if len(ContentSecurityPolicy) > 0 {
+			header.Set("Content-Security-Policy", ContentSecurityPolicy)
+		}
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Permissions-Policy", PermissionsPolicy)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// HealthHandler answers as soon as the process is serving.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "ok")
+}
+
+// Readiness is the startup work /readyz waits on, as named checks.
+type Readiness struct {
+	mu     sync.RWMutex
+	names  []string
+	checks map[string]func() bool
+}
+
+func (rd *Readiness) Require(name string, check func() bool) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if rd.checks == nil {
+		rd.checks = make(map[string]func() bool)
+	}
+	if _, ok := rd.checks[name]; !ok {
+		rd.names = append(rd.names, name)
+	}
+	rd.checks[name] = check
+}
+
+// Pending lists the checks that haven't passed yet.
+func (rd *Readiness) Pending() []string {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	var pending []string
+	for _, name := range rd.names {
+		if !rd.checks[name]() {
+			pending = append(pending, name)
+		}
+	}
+	return pending
+}
+
+// ReadyHandler answers 200 once every check in rd passes and 503 until
+// then, naming what it is still waiting for.
+func ReadyHandler(rd *Readiness) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if pending := rd.Pending(); len(pending) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "waiting for: %s\n", strings.Join(pending, ", "))
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	}
+}
+
 // page model
 type Page struct {
 	IsTor       bool
@@ -26,9 +135,202 @@ type Page struct {
 	Lang        string
 	IP          string
 	Locales     map[string]string
+	Nonce       string
+	TBBInfo     bool
+	DownloadURL string
+	// which of LangSources Lang came from, for the metrics; empty when
+	// it wasn't negotiated
+	langSource string
 }
 
-func RootHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain, Phttp *http.ServeMux, Locales map[string]string) http.HandlerFunc {
+// the outcome of checking a single request
+type CheckResult struct {
+	IsTor       bool
+	Fingerprint string
+	// redacted as configured with -redactip, so fine to show
+	IP         string
+	LikelyTBB  bool
+	Stale      bool
+	Private    bool
+	Confidence int
+	// heuristic only, and never part of the verdict
+	Scanner bool
+}
+
+// exit lists are refreshed hourly, so a few missed updates mean the
+// verdict may be out of date
+var StaleAfter = 3 * time.Hour
+
+// weights combined by Confidence
+const (
+	ConfidenceExitMatch    = 80
+	ConfidenceTBB          = 20
+	ConfidenceStalePenalty = 30
+	ConfidenceUnknown      = -1
+)
+
+// Confidence scores, from 0 to 100, how strongly the signals in res say
+// the request came over Tor. An exit list match carries most of the
+// weight, a Tor Browser user agent supports it, and stale exit data
+// counts against it. Private addresses mean we are not seeing the real
+// client, so the score is ConfidenceUnknown.
+func Confidence(res CheckResult) int {
+	if res.Private {
+		return ConfidenceUnknown
+	}
+	score := 0
+	if res.IsTor {
+		score += ConfidenceExitMatch
+	}
+	if res.LikelyTBB {
+		score += ConfidenceTBB
+	}
+	if res.Stale {
+		score -= ConfidenceStalePenalty
+	}
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+// CheckRequest gathers every signal we have about where r came from.
+func CheckRequest(r *http.Request, Exits *Exits) (res CheckResult) {
+	var err error
+	if res.IP, err = GetHost(r); err == nil {
+		res.Fingerprint, res.IsTor = Exits.IsTor(res.IP)
+	}
+	res.LikelyTBB = LikelyTBB(r.UserAgent())
+	res.Stale = time.Since(Exits.UpdateTime) > StaleAfter
+	res.Private = IsPrivateIP(res.IP)
+	res.Confidence = Confidence(res)
+	res.Scanner = LikelyScanner(r)
+	res.IP = RedactIP(res.IP, IPRedaction)
+	Stats.CountCheck(res.IsTor)
+	if res.Scanner {
+		Stats.Scanners.Inc()
+	}
+	return
+}
+
+// set by -tbbinfo and -download; explains Tor Browser to visitors who
+// aren't using Tor
+var (
+	ShowTBBInfo bool
+	DownloadURL = "https://www.torproject.org/download/"
+)
+
+// set by -hidetbb so the page only reflects the exit list verdict; the
+// user agent guess is still reported by CheckRequest
+var HideTBBMessaging bool
+
+// BuildTemplateData assembles everything the templates need for r, so
+// every renderer gets the same model.
+func BuildTemplateData(r *http.Request, res CheckResult, Locales map[string]string) Page {
+	var onOff string
+
+	// try to determine if it's TBB
+	notTBB := !res.LikelyTBB && !HideTBBMessaging
+
+	// users shouldn't be relying on check
+	// to determine the TBB is up-to-date
+	// always return false to this param
+	notUpToDate := IsParamSet(r, "uptodate")
+
+	// string used for classes and such
+	// in the template
+	if res.IsTor {
+		if notTBB || notUpToDate {
+			onOff = "not"
+		} else {
+			onOff = "on"
+		}
+	} else {
+		onOff = "off"
+	}
+
+	lang := negotiateLanguage(r, Locales)
+
+	// instance of your page model
+	return Page{
+		res.IsTor,
+		notUpToDate,
+		IsParamSet(r, "small"),
+		notTBB,
+		res.Fingerprint,
+		onOff,
+		lang.Matched,
+		res.IP,
+		Locales,
+		// busts caches for the "check again" link
+		strconv.FormatInt(time.Now().UnixNano(), 36),
+		ShowTBBInfo && !res.IsTor,
+		DownloadURL,
+		lang.Source,
+	}
+}
+
+// Templated hands h the compiled templateName. In DevMode it compiles
+// again for every request, so template edits show up on reload, and
+// Config.TemplatesOK follows the latest compile.
+//
+// Only a broken base layout is returned as an error, and only outside
+// DevMode, since no page could be served. If just templateName fails,
+// that is logged and h gets a nil template, so whatever it serves
+// without one keeps working and WriteHTMLBuf sends the fallback page.
+func (c *Config) Templated(domain *gettext.Domain, templateName string, h func(*template.Template) http.HandlerFunc) (http.HandlerFunc, error) {
+	l, err := c.compileNoted(domain, templateName)
+	if !c.DevMode {
+		var layoutErr *LayoutError
+		if errors.As(err, &layoutErr) {
+			return nil, err
+		}
+		if err != nil {
+			Log.Errorf("template=%s CompileTemplate: %v", templateName, err)
+		}
+		return h(l), nil
+	}
+	if err != nil {
+		Log.Errorf("template=%s CompileTemplate: %v", templateName, err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		l, err := c.compileNoted(domain, templateName)
+		if err != nil {
+			Log.Errorf("template=%s CompileTemplate: %v", templateName, err)
+		}
+		h(l)(w, r)
+	}, nil
+}
+
+// compileNoted is CompileTemplate, keeping the error for TemplatesOK.
+func (c *Config) compileNoted(domain *gettext.Domain, templateName string) (*template.Template, error) {
+	l, err := c.CompileTemplate(domain, templateName)
+	c.noteTemplate(templateName, err)
+	return l, err
+}
+
+const FallbackMessage = "Sorry, your query failed or an unexpected response was received."
+
+// what a page gets when its template fails, so it needs no templates
+const fallbackPage = `<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>Tor Check</title></head>
+<body><h1>%s</h1></body>
+</html>
+`
+
+// WriteFallback answers with a minimal page saying msg and a 500.
+func WriteFallback(w http.ResponseWriter, msg string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("X-Template")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, fallbackPage, template.HTMLEscapeString(msg))
+}
+
+func RootHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain, Phttp *http.ServeMux, Locales *LocaleCache) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -38,81 +340,193 @@ func RootHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain
 			return
 		}
 
-		var (
-			err         error
-			isTor       bool
-			host        string
-			onOff       string
-			fingerprint string
-		)
+		// the format depends on Accept and the page's language on
+		// Accept-Language and the lang cookie, so caches must keep them
+		// apart
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Accept-Language")
+		w.Header().Add("Vary", "Cookie")
+
+		// a re-check after changing circuits must never be answered
+		// from a cache along the way
+		if IsParamSet(r, "recheck") {
+			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		}
+
+		res := CheckRequest(r, Exits)
+
+		// scripts can ask for the result without the page
+		switch format := r.URL.Query().Get("format"); {
+		case format == "json" || Accepts(r, "application/json"):
+			WriteJSONResult(w, r, res)
+			return
+		case format == "text" || Accepts(r, "text/plain"):
+			WriteTextResult(w, res)
+			return
+		}
 
-		if host, err = GetHost(r); err == nil {
-			fingerprint, isTor = Exits.IsTor(host)
+		p := BuildTemplateData(r, res, Locales.Get())
+		if picked := MatchLocale(r.URL.Query().Get("lang"), p.Locales); len(picked) > 0 {
+			SetLangCookie(w, picked)
 		}
 
 		// short circuit for torbutton
 		if IsParamSet(r, "TorButton") {
-			WriteHTMLBuf(w, r, Layout, domain, "torbutton.html", Page{IsTor: isTor})
+			WriteHTMLBuf(w, r, Layout, domain, "torbutton.html", p)
 			return
 		}
 
-		// try to determine if it's TBB
-		notTBB := !LikelyTBB(r.UserAgent())
+		// render the template
+		WriteHTMLBuf(w, r, Layout, domain, "index.html", p)
+	}
+
+}
 
-		// users shouldn't be relying on check
-		// to determine the TBB is up-to-date
-		// always return false to this param
-		notUpToDate := IsParamSet(r, "uptodate")
+// The JSON API is versioned. Within a version, responses only ever gain
+// fields; removing or changing the meaning of one means a new version.
+// Clients pin the shape they understand with ?v=N or an Accept parameter
+// like "application/json; v=N" and otherwise get APISchemaVersion. Every
+// JSON response names its version in an X-Schema-Version header, and
+// objects also carry it in a SchemaVersion field. The bulk list is a
+// bare array, so it only has the header.
+const APISchemaVersion = 1
 
-		// string used for classes and such
-		// in the template
-		if isTor {
-			if notTBB || notUpToDate {
-				onOff = "not"
-			} else {
-				onOff = "on"
+var APISchemaVersions = map[int]bool{1: true}
+
+// SchemaVersion returns the version r asked for, or APISchemaVersion.
+// ok is false if the requested version isn't one we serve.
+func SchemaVersion(r *http.Request) (v int, ok bool) {
+	requested := r.URL.Query().Get("v")
+	if len(requested) == 0 {
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			mediaType, params, err := mime.ParseMediaType(accept)
+			if err == nil && mediaType == "application/json" && len(params["v"]) > 0 {
+				requested = params["v"]
+				break
 			}
-		} else {
-			onOff = "off"
 		}
+	}
+	if len(requested) == 0 {
+		return APISchemaVersion, true
+	}
+	v, err := strconv.Atoi(requested)
+	return v, err == nil && APISchemaVersions[v]
+}
+
+// NegotiateSchema sets the response headers for the version r asked for,
+// or answers with a 406 and returns false.
+func NegotiateSchema(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v, ok := SchemaVersion(r)
+	if !ok {
+		http.Error(w, "Unsupported schema version", http.StatusNotAcceptable)
+		return 0, false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Schema-Version", strconv.Itoa(v))
+	return v, true
+}
+
+type IPResp struct {
+	IsTor            bool
+	IP               string
+	Confidence       int
+	SchemaVersion    int
+	LikelyTorBrowser bool
+	LikelyScanner    bool
+}
+
+type LocalesResp struct {
+	SchemaVersion int
+	Locales       map[string]string
+}
+
+// LocalesHandler serves the installed locales with an ETag, so clients
+// can revalidate rather than download them again.
+func LocalesHandler(Locales *LocaleCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := NegotiateSchema(w, r); !ok {
+			return
+		}
+		body, etag := Locales.JSON()
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(Locales.TTL.Seconds())))
+		if NoneMatch(r, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(body)
+	}
+}
 
-		// instance of your page model
-		p := Page{
-			isTor,
-			notUpToDate,
-			IsParamSet(r, "small"),
-			notTBB,
-			fingerprint,
-			onOff,
-			Lang(r),
-			host,
-			Locales,
+// NoneMatch reports whether r's If-None-Match lists etag, comparing
+// weakly as RFC 7232 asks for GET and HEAD.
+func NoneMatch(r *http.Request, etag string) bool {
+	if len(etag) == 0 {
+		return false
+	}
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+			return true
 		}
+	}
+	return false
+}
 
-		// render the template
-		WriteHTMLBuf(w, r, Layout, domain, "index.html", p)
+// acceptQ is the highest q r's Accept header gives mediaType, or 0 if it
+// isn't listed. Wildcards are ignored since browsers send */* with
+// everything.
+func acceptQ(r *http.Request, mediaType string) float64 {
+	best := 0.0
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(accept)
+		if err != nil || mt != mediaType {
+			continue
+		}
+		q := 1.0
+		if v, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = v
+		}
+		if q > best {
+			best = q
+		}
 	}
+	return best
+}
 
+// Accepts reports whether r's Accept header prefers mediaType to
+// text/html. Ties go to the page, which stays the default.
+func Accepts(r *http.Request, mediaType string) bool {
+	return acceptQ(r, mediaType) > acceptQ(r, "text/html")
 }
 
-type IPResp struct {
-	IsTor bool
-	IP    string
+func WriteJSONResult(w http.ResponseWriter, r *http.Request, res CheckResult) {
+	v, ok := NegotiateSchema(w, r)
+	if !ok {
+		return
+	}
+	ip, _ := json.Marshal(IPResp{res.IsTor, res.IP, res.Confidence, v, res.LikelyTBB, res.Scanner})
+	w.Write(ip)
+}
+
+// one fixed, untranslated line each, so scripts can grep for them
+const (
+	TextIsTor  = "Congratulations. This browser is configured to use Tor."
+	TextNotTor = "Sorry. You are not using Tor."
+)
+
+func WriteTextResult(w http.ResponseWriter, res CheckResult) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if res.IsTor {
+		fmt.Fprintln(w, TextIsTor)
+	} else {
+		fmt.Fprintln(w, TextNotTor)
+	}
 }
 
 func APIHandler(Exits *Exits) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		var (
-			err   error
-			isTor bool
-			host  string
-		)
-		if host, err = GetHost(r); err == nil {
-			_, isTor = Exits.IsTor(host)
-		}
-		ip, _ := json.Marshal(IPResp{isTor, host})
-		w.Write(ip)
+		WriteJSONResult(w, r, CheckRequest(r, Exits))
 	}
 }
 
@@ -125,17 +539,22 @@ func BulkHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain
 
 		ip := q.Get("ip")
 		if net.ParseIP(ip) == nil {
-			WriteHTMLBuf(w, r, Layout, domain, "bulk.html", Page{Lang: "en"})
+			// the bulk page isn't translated and doesn't show a result
+			p := BuildTemplateData(r, CheckResult{}, nil)
+			p.Lang, p.langSource = "en", ""
+			WriteHTMLBuf(w, r, Layout, domain, "bulk.html", p)
 			return
 		}
 
-		port, port_str := GetQS(q, "port", 80)
-		n, n_str := GetQS(q, "n", 16)
+		port, port_str := GetQSRange(q, "port", 80, 1, 65535)
+		n, n_str := GetQSRange(q, "n", 16, 0, math.MaxInt32)
 
 		w.Header().Set("Last-Modified", Exits.UpdateTime.UTC().Format(http.TimeFormat))
 
 		if q.Get("format") == "json" || ApiPath.MatchString(r.URL.Path) {
-			w.Header().Set("Content-Type", "application/json")
+			if _, ok := NegotiateSchema(w, r); !ok {
+				return
+			}
 			Exits.DumpJSON(w, n, ip, port)
 		} else {
 			str := fmt.Sprintf("# This is a list of all Tor exit nodes from the past %d hours that can contact %s on port %d #\n", n, ip, port)
@@ -149,16 +568,35 @@ func BulkHandler(Layout *template.Template, Exits *Exits, domain *gettext.Domain
 
 }
 
+// set by -debug; exposes which template served a request
+var Debug bool
+
 func WriteHTMLBuf(w http.ResponseWriter, r *http.Request, Layout *template.Template, domain *gettext.Domain, tmp string, p Page) {
+	// the page didn't compile; Templated has logged why
+	if Layout == nil {
+		Log.Errorf("template=%s lang=%s not compiled, serving the fallback", tmp, p.Lang)
+		WriteFallback(w, domain.GetText(p.Lang, FallbackMessage))
+		return
+	}
+
 	buf := new(bytes.Buffer)
 
 	// render template
-	if err := Layout.ExecuteTemplate(buf, tmp, p); err != nil {
-		log.Printf("Layout.ExecuteTemplate: %v", err)
-		http.Error(w, domain.GetText(p.Lang, "Sorry, your query failed or an unexpected response was received."), http.StatusInternalServerError)
+	start := time.Now()
+	err := Layout.ExecuteTemplate(buf, tmp, p)
+	Stats.RenderSeconds.Observe(time.Since(start))
+	if err != nil {
+		Log.Errorf("template=%s lang=%s Layout.ExecuteTemplate: %v", tmp, p.Lang, err)
+		WriteFallback(w, domain.GetText(p.Lang, FallbackMessage))
 		return
 	}
 
+	Stats.CountLang(p.Lang, p.langSource)
+	Log.Debugf("template=%s lang=%s rendered %s %s", tmp, p.Lang, r.Method, r.URL.Path)
+	if Debug {
+		w.Header().Set("X-Template", tmp)
+	}
+
 	// set some headers
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if r.Method == "HEAD" {
@@ -168,6 +606,6 @@ func WriteHTMLBuf(w http.ResponseWriter, r *http.Request, Layout *template.Templ
 
 	// write buf
 	if _, err := io.Copy(w, buf); err != nil {
-		log.Printf("io.Copy: %v", err)
+		Log.Warnf("template=%s io.Copy: %v", tmp, err)
 	}
 }
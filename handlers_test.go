@@ -0,0 +1,663 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func serve(h http.Handler, method string, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// varies reports whether any Vary header in h names field
+func varies(h http.Header, field string) bool {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestMethodGuard(t *testing.T) {
+	// the guard has to answer before the handler touches its dependencies
+	root := MethodGuard(PageMethods, RootHandler(nil, nil, nil, nil, nil))
+
+	w := serve(root, "PUT", "/")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT / returned %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+		t.Errorf("PUT / returned Allow: %q", allow)
+	}
+
+	w = serve(root, "OPTIONS", "/")
+	if w.Code != http.StatusOK {
+		t.Errorf("OPTIONS / returned %d, expected %d", w.Code, http.StatusOK)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+		t.Errorf("OPTIONS / returned Allow: %q", allow)
+	}
+
+	api := MethodGuard(APIMethods, APIHandler(new(Exits)))
+	if w = serve(api, "POST", "/api/ip"); w.Code != http.StatusOK {
+		t.Errorf("POST /api/ip returned %d, expected %d", w.Code, http.StatusOK)
+	}
+	w = serve(api, "DELETE", "/api/ip")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /api/ip returned %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS, POST" {
+		t.Errorf("DELETE /api/ip returned Allow: %q", allow)
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	cases := []struct {
+		res      CheckResult
+		expected int
+	}{
+		{CheckResult{}, 0},
+		{CheckResult{IsTor: true}, ConfidenceExitMatch},
+		{CheckResult{LikelyTBB: true}, ConfidenceTBB},
+		{CheckResult{IsTor: true, LikelyTBB: true}, 100},
+		{CheckResult{IsTor: true, Stale: true}, ConfidenceExitMatch - ConfidenceStalePenalty},
+		{CheckResult{IsTor: true, LikelyTBB: true, Stale: true}, 100 - ConfidenceStalePenalty},
+		{CheckResult{LikelyTBB: true, Stale: true}, 0},
+		{CheckResult{Stale: true}, 0},
+		{CheckResult{Private: true}, ConfidenceUnknown},
+		{CheckResult{IsTor: true, LikelyTBB: true, Private: true}, ConfidenceUnknown},
+	}
+	for _, c := range cases {
+		if got := Confidence(c.res); got != c.expected {
+			t.Errorf("Confidence(%+v) = %d, expected %d", c.res, got, c.expected)
+		}
+	}
+}
+
+func TestCheckRequest(t *testing.T) {
+	exits := setupExitList(t, testExit)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "91.121.43.80:1234"
+	r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 6.1; rv:60.0) Gecko/20100101 Firefox/60.0")
+	if res := CheckRequest(r, exits); !res.IsTor || res.Fingerprint != "1" || res.Confidence != 100 {
+		t.Errorf("Unexpected result for a Tor Browser exit: %+v", res)
+	}
+	// without an Accept header this looks scripted, which mustn't
+	// change the verdict
+	if res := CheckRequest(r, exits); !res.Scanner || !res.IsTor || res.Confidence != 100 {
+		t.Errorf("Unexpected result for a scripted request: %+v", res)
+	}
+	r.Header.Set("Accept", "text/html")
+	if res := CheckRequest(r, exits); res.Scanner {
+		t.Errorf("Unexpected scanner flag for a browser: %+v", res)
+	}
+
+	exits.UpdateTime = exits.UpdateTime.Add(-2 * StaleAfter)
+	if res := CheckRequest(r, exits); !res.Stale || res.Confidence != 100-ConfidenceStalePenalty {
+		t.Errorf("Unexpected result for stale exit data: %+v", res)
+	}
+
+	r.RemoteAddr = "192.168.1.1:1234"
+	if res := CheckRequest(r, exits); !res.Private || res.Confidence != ConfidenceUnknown {
+		t.Errorf("Unexpected result for a private address: %+v", res)
+	}
+}
+
+func TestBuildTemplateData(t *testing.T) {
+	locales := map[string]string{"en_US": "English", "de": "Deutsch"}
+	cases := []struct {
+		target string
+		res    CheckResult
+		onOff  string
+	}{
+		{"/", CheckResult{IsTor: true, LikelyTBB: true}, "on"},
+		{"/", CheckResult{IsTor: true}, "not"},
+		{"/?uptodate=0", CheckResult{IsTor: true, LikelyTBB: true}, "not"},
+		{"/", CheckResult{LikelyTBB: true}, "off"},
+	}
+	for _, c := range cases {
+		p := BuildTemplateData(httptest.NewRequest("GET", c.target, nil), c.res, locales)
+		if p.OnOff != c.onOff {
+			t.Errorf("%s with %+v: got OnOff %q, expected %q", c.target, c.res, p.OnOff, c.onOff)
+		}
+	}
+
+	p := BuildTemplateData(httptest.NewRequest("GET", "/?small=1&lang=de", nil), CheckResult{IP: "1.2.3.4", Fingerprint: "F"}, locales)
+	if !p.Small || p.Lang != "de" || p.IP != "1.2.3.4" || p.Fingerprint != "F" || len(p.Locales) != 2 {
+		t.Errorf("Unexpected page model: %+v", p)
+	}
+}
+
+var testDomain = NullDomain()
+
+func TestTemplateHeader(t *testing.T) {
+	layout := template.Must(template.New("").Parse(`{{ define "test.html" }}{{ .IP }}{{ end }}`))
+	logs := recordLogs(t)
+
+	w := httptest.NewRecorder()
+	WriteHTMLBuf(w, httptest.NewRequest("GET", "/?lang=de", nil), layout, testDomain, "test.html", Page{IP: "1.2.3.4", Lang: "de"})
+	if h := w.Header().Get("X-Template"); h != "" {
+		t.Errorf("Expected no X-Template header outside debug mode, got %q", h)
+	}
+	if !logs.has("debug: template=test.html lang=de rendered GET /") || logs.has("debug: template=test.html lang=de rendered GET /?") {
+		t.Errorf("Expected the render logged at debug level without the query, got %q", logs.entries)
+	}
+
+	Debug = true
+	defer func() { Debug = false }()
+	w = httptest.NewRecorder()
+	WriteHTMLBuf(w, httptest.NewRequest("GET", "/", nil), layout, testDomain, "test.html", Page{IP: "1.2.3.4"})
+	if h := w.Header().Get("X-Template"); h != "test.html" {
+		t.Errorf("Expected X-Template: test.html in debug mode, got %q", h)
+	}
+	if w.Body.String() != "1.2.3.4" {
+		t.Errorf("Unexpected body %q", w.Body.String())
+	}
+
+	WriteHTMLBuf(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), layout, testDomain, "missing.html", Page{})
+	if !logs.has("error: template=missing.html") {
+		t.Errorf("Expected the failing template to be logged, got %q", logs.entries)
+	}
+}
+
+func TestRecheck(t *testing.T) {
+	layout := template.Must(template.New("").Parse(`{{ define "index.html" }}{{ .IP }} {{ .Nonce }}{{ end }}`))
+	exits := setupExitList(t, testExit)
+	root := RootHandler(layout, exits, testDomain, http.NewServeMux(), nil)
+
+	r := httptest.NewRequest("GET", "/?recheck=abc", nil)
+	r.RemoteAddr = "91.121.43.80:1234"
+	w := httptest.NewRecorder()
+	root(w, r)
+	if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "no-store") {
+		t.Errorf("Expected a re-check not to be cached, got Cache-Control: %q", cc)
+	}
+	if !strings.HasPrefix(w.Body.String(), "91.121.43.80 ") || len(w.Body.String()) == len("91.121.43.80 ") {
+		t.Errorf("Expected the page to show the address and a fresh nonce, got %q", w.Body.String())
+	}
+
+	w = serve(root, "GET", "/")
+	if cc := w.Header().Get("Cache-Control"); cc != "" {
+		t.Errorf("Expected no Cache-Control on a normal check, got %q", cc)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	api := APIHandler(new(Exits))
+	cases := []struct {
+		target  string
+		accept  string
+		code    int
+		version string
+	}{
+		{"/api/ip", "", http.StatusOK, "1"},
+		{"/api/ip?v=1", "", http.StatusOK, "1"},
+		{"/api/ip", "application/json; v=1", http.StatusOK, "1"},
+		{"/api/ip", "text/html, application/json;v=1;q=0.9", http.StatusOK, "1"},
+		{"/api/ip", "application/json", http.StatusOK, "1"},
+		{"/api/ip?v=2", "", http.StatusNotAcceptable, ""},
+		{"/api/ip?v=one", "", http.StatusNotAcceptable, ""},
+		{"/api/ip", "application/json; v=0", http.StatusNotAcceptable, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.target, nil)
+		if len(c.accept) > 0 {
+			r.Header.Set("Accept", c.accept)
+		}
+		w := httptest.NewRecorder()
+		api(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s (Accept: %s) returned %d, expected %d", c.target, c.accept, w.Code, c.code)
+		}
+		if v := w.Header().Get("X-Schema-Version"); v != c.version {
+			t.Errorf("%s (Accept: %s) returned X-Schema-Version %q, expected %q", c.target, c.accept, v, c.version)
+		}
+		if c.code == http.StatusOK && !strings.Contains(w.Body.String(), `"SchemaVersion":1`) {
+			t.Errorf("%s (Accept: %s) body is missing its version: %s", c.target, c.accept, w.Body.String())
+		}
+	}
+}
+
+func TestHideTBBMessaging(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	res := CheckResult{IsTor: true}
+	if p := BuildTemplateData(r, res, nil); !p.NotTBB || p.OnOff != "not" {
+		t.Errorf("Expected the Tor Browser warning by default, got %+v", p)
+	}
+
+	HideTBBMessaging = true
+	defer func() { HideTBBMessaging = false }()
+	if p := BuildTemplateData(r, res, nil); p.NotTBB || p.OnOff != "on" {
+		t.Errorf("Expected no Tor Browser warning when hidden, got %+v", p)
+	}
+	// outdated Tor Browser warnings don't depend on the user agent
+	if p := BuildTemplateData(httptest.NewRequest("GET", "/?uptodate=0", nil), res, nil); p.OnOff != "not" {
+		t.Errorf("Expected the update warning to remain, got %+v", p)
+	}
+}
+
+func TestRedactedOutputs(t *testing.T) {
+	exits := setupExitList(t, testExit)
+	IPRedaction = RedactPartial
+	defer func() { IPRedaction = RedactNone }()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "91.121.43.80:1234"
+	res := CheckRequest(r, exits)
+	if !res.IsTor || res.IP != "91.121.43.0" {
+		t.Errorf("Expected the verdict with a coarsened address, got %+v", res)
+	}
+	if p := BuildTemplateData(r, res, nil); p.IP != "91.121.43.0" {
+		t.Errorf("Expected the page to show the coarsened address, got %q", p.IP)
+	}
+
+	w := httptest.NewRecorder()
+	APIHandler(exits)(w, r)
+	if body := w.Body.String(); !strings.Contains(body, `"IP":"91.121.43.0"`) || !strings.Contains(body, `"IsTor":true`) {
+		t.Errorf("Expected the API to return the coarsened address, got %s", body)
+	}
+}
+
+func TestTBBInfo(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if p := BuildTemplateData(r, CheckResult{}, nil); p.TBBInfo {
+		t.Error("Expected no Tor Browser explanation unless enabled")
+	}
+
+	ShowTBBInfo = true
+	defer func() { ShowTBBInfo = false }()
+	if p := BuildTemplateData(r, CheckResult{}, nil); !p.TBBInfo || p.DownloadURL != DownloadURL {
+		t.Errorf("Expected the Tor Browser explanation when not on Tor, got %+v", p)
+	}
+	if p := BuildTemplateData(r, CheckResult{IsTor: true}, nil); p.TBBInfo {
+		t.Error("Expected no Tor Browser explanation for Tor users")
+	}
+}
+
+func TestTemplatedDevMode(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for k, v := range testFiles {
+		fsys[k] = v
+	}
+	c := NewConfigFS(fsys)
+	c.DevMode = true
+	h, err := c.Templated(testDomain, "index.html", func(l *template.Template) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			WriteHTMLBuf(w, r, l, testDomain, "index.html", Page{IP: "1.2.3.4"})
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.TemplatesOK() {
+		t.Error("Expected the templates to be ready before any request")
+	}
+	if body := serve(h, "GET", "/").Body.String(); body != "<title>1.2.3.4</title>" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	fsys["public/index.html"] = &fstest.MapFile{Data: []byte(`{{ define "index.html" }}{{ .IP `)}
+	recordLogs(t)
+	serve(h, "GET", "/")
+	if c.TemplatesOK() {
+		t.Error("Expected a broken edit to make the templates unready")
+	}
+	fsys["public/index.html"] = testFiles["public/index.html"]
+	fsys["public/base.html"] = &fstest.MapFile{Data: []byte(`{{ define "base.html" }}<h1>{{ template "title" . }}</h1>{{ end }}`)}
+	if body := serve(h, "GET", "/").Body.String(); body != "<h1>1.2.3.4</h1>" {
+		t.Errorf("Expected the edited layout on the next request, got %q", body)
+	}
+	if !c.TemplatesOK() {
+		t.Error("Expected fixing the page to make the templates ready again")
+	}
+}
+
+func TestTemplateFallback(t *testing.T) {
+	logs := recordLogs(t)
+	fsys := fstest.MapFS{}
+	for k, v := range testFiles {
+		fsys[k] = v
+	}
+	fsys["public/index.html"] = &fstest.MapFile{Data: []byte(`{{ define "index.html" }}{{ .IP `)}
+	fsys["public/bulk.html"] = &fstest.MapFile{Data: []byte(`{{ define "bulk.html" }}<p>{{ .IP }}</p>{{ end }}`)}
+	fsys["public/base.css"] = &fstest.MapFile{Data: []byte(`body {}`)}
+	public, err := fs.Sub(fsys, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Phttp := http.NewServeMux()
+	Phttp.Handle("/", http.FileServer(http.FS(public)))
+	exits := setupExitList(t, testExit)
+
+	// a broken index.html only takes out the pages rendered from it
+	c := NewConfigFS(fsys)
+	root, err := c.Templated(testDomain, "index.html", func(l *template.Template) http.HandlerFunc {
+		return RootHandler(l, exits, testDomain, Phttp, nil)
+	})
+	if err != nil {
+		t.Fatalf("Expected a broken page not to be fatal, got %v", err)
+	}
+	bulk, err := c.Templated(testDomain, "bulk.html", func(l *template.Template) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			WriteHTMLBuf(w, r, l, testDomain, "bulk.html", Page{IP: "1.2.3.4"})
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/bulk", bulk)
+	mux.Handle("/", root)
+	if !logs.has("error: template=index.html CompileTemplate:") {
+		t.Errorf("Expected an error for the page, got %q", logs.entries)
+	}
+	if c.TemplatesOK() {
+		t.Error("Expected a broken page to keep the templates from being ready")
+	}
+	for _, target := range []string{"/", "/?TorButton=1"} {
+		w := serve(mux, "GET", target)
+		if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "<h1>Sorry, your query failed") {
+			t.Errorf("%s: expected the fallback page, got %d %q", target, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("%s: unexpected Content-Type %q", target, ct)
+		}
+	}
+	for target, expected := range map[string]string{
+		"/base.css":     "body {}",
+		"/?format=json": `"IsTor"`,
+		"/?format=text": TextNotTor,
+		"/bulk":         "<p>1.2.3.4</p>",
+	} {
+		if w := serve(mux, "GET", target); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("%s: expected %q with a 200, got %d %q", target, expected, w.Code, w.Body.String())
+		}
+	}
+
+	// so is one that fails while rendering
+	layout := template.Must(template.New("").Parse(`{{ define "index.html" }}<p>{{ .Missing }}</p>{{ end }}`))
+	w := serve(RootHandler(layout, exits, testDomain, Phttp, nil), "GET", "/")
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "<p>") || !strings.Contains(w.Body.String(), "Sorry") {
+		t.Errorf("Expected the fallback page, got %d %q", w.Code, w.Body.String())
+	}
+	if !logs.has("error: template=index.html lang=en_US Layout.ExecuteTemplate:") {
+		t.Errorf("Expected an error for the render, got %q", logs.entries)
+	}
+
+	// but nothing can be served without the base layout
+	fsys["public/base.html"] = &fstest.MapFile{Data: []byte(`{{ define "base.html" }}{{ end `)}
+	_, err = NewConfigFS(fsys).Templated(testDomain, "bulk.html", func(*template.Template) http.HandlerFunc { return nil })
+	var layoutErr *LayoutError
+	if !errors.As(err, &layoutErr) {
+		t.Errorf("Expected a LayoutError, got %v", err)
+	}
+}
+
+func TestRootJSON(t *testing.T) {
+	// rendering would fail, so these must not touch the template
+	layout := template.Must(template.New("").Parse(`{{ define "index.html" }}{{ .Missing }}{{ end }}`))
+	exits := setupExitList(t, testExit)
+	root := RootHandler(layout, exits, testDomain, http.NewServeMux(), nil)
+
+	for _, c := range []struct {
+		target string
+		accept string
+	}{
+		{"/?format=json", ""},
+		{"/", "application/json"},
+		{"/", "text/html;q=0.5, application/json"},
+	} {
+		r := httptest.NewRequest("GET", c.target, nil)
+		r.RemoteAddr = "91.121.43.80:1234"
+		r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 6.1; rv:60.0) Gecko/20100101 Firefox/60.0")
+		if len(c.accept) > 0 {
+			r.Header.Set("Accept", c.accept)
+		}
+		w := httptest.NewRecorder()
+		root(w, r)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s (Accept: %s): got Content-Type %q", c.target, c.accept, ct)
+		}
+		var resp IPResp
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s (Accept: %s): %v in %q", c.target, c.accept, err, w.Body.String())
+		}
+		if !resp.IsTor || resp.IP != "91.121.43.80" || !resp.LikelyTorBrowser || resp.LikelyScanner != (len(c.accept) == 0) {
+			t.Errorf("%s (Accept: %s): unexpected result %+v", c.target, c.accept, resp)
+		}
+	}
+
+	// browsers still get the page
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	w := httptest.NewRecorder()
+	root(w, r)
+	if ct := w.Header().Get("Content-Type"); ct == "application/json" {
+		t.Error("Expected HTML for a browser's Accept header")
+	}
+	if !varies(w.Header(), "Accept") {
+		t.Errorf("Expected Vary: Accept, got %q", w.Header()["Vary"])
+	}
+	for _, accept := range []string{
+		"application/json;q=0",
+		"text/html, application/json;q=0.1",
+		"application/json, text/html",
+	} {
+		r.Header.Set("Accept", accept)
+		w = httptest.NewRecorder()
+		root(w, r)
+		if ct := w.Header().Get("Content-Type"); ct == "application/json" {
+			t.Errorf("Expected HTML for Accept: %s", accept)
+		}
+		if !varies(w.Header(), "Accept") {
+			t.Errorf("Expected Vary: Accept for Accept: %s, got %q", accept, w.Header()["Vary"])
+		}
+	}
+}
+
+func TestRootText(t *testing.T) {
+	layout := template.Must(template.New("").Parse(`{{ define "index.html" }}{{ .Missing }}{{ end }}`))
+	exits := setupExitList(t, testExit)
+	root := RootHandler(layout, exits, testDomain, http.NewServeMux(), nil)
+
+	cases := []struct {
+		remoteAddr string
+		target     string
+		accept     string
+		expected   string
+	}{
+		{"91.121.43.80:1234", "/?format=text", "", "Congratulations. This browser is configured to use Tor.\n"},
+		{"91.121.43.80:1234", "/", "text/plain", "Congratulations. This browser is configured to use Tor.\n"},
+		{"203.0.113.5:1234", "/?format=text", "", "Sorry. You are not using Tor.\n"},
+		{"203.0.113.5:1234", "/?format=text&lang=de", "", "Sorry. You are not using Tor.\n"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.target, nil)
+		r.RemoteAddr = c.remoteAddr
+		if len(c.accept) > 0 {
+			r.Header.Set("Accept", c.accept)
+		}
+		w := httptest.NewRecorder()
+		root(w, r)
+		if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("%s from %s: got Content-Type %q", c.target, c.remoteAddr, ct)
+		}
+		if body := w.Body.String(); body != c.expected {
+			t.Errorf("%s from %s: got %q, expected %q", c.target, c.remoteAddr, body, c.expected)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	layout := template.Must(template.New("").Parse(`{{ define "index.html" }}<p>{{ .IP }}</p>{{ end }}`))
+	exits := setupExitList(t, testExit)
+	root := SecurityHeaders(MethodGuard(PageMethods, RootHandler(layout, exits, testDomain, http.NewServeMux(), nil)))
+
+	expected := map[string]string{
+		"Content-Security-Policy": ContentSecurityPolicy,
+		"X-Content-Type-Options":  "nosniff",
+		"Referrer-Policy":         "no-referrer",
+		"Permissions-Policy":      PermissionsPolicy,
+	}
+	for _, method := range []string{"GET", "PUT"} {
+		w := serve(root, method, "/")
+		for k, v := range expected {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("%s /: expected %s: %q, got %q", method, k, v, got)
+			}
+		}
+	}
+	if !strings.Contains(ContentSecurityPolicy, "default-src 'none'") {
+		t.Errorf("Expected the default policy to deny by default, got %q", ContentSecurityPolicy)
+	}
+
+	defer func(saved string) { ContentSecurityPolicy = saved }(ContentSecurityPolicy)
+	ContentSecurityPolicy = "default-src 'self'"
+	if got := serve(root, "GET", "/").Header().Get("Content-Security-Policy"); got != "default-src 'self'" {
+		t.Errorf("Expected the configured policy, got %q", got)
+	}
+	ContentSecurityPolicy = ""
+	if _, ok := serve(root, "GET", "/").Header()["Content-Security-Policy"]; ok {
+		t.Error("Expected no policy when it is configured empty")
+	}
+}
+
+func TestSetLangCookie(t *testing.T) {
+	layout := template.Must(template.New("").Parse(`{{ define "index.html" }}{{ .Lang }}{{ end }}`))
+	exits := setupExitList(t, testExit)
+	root := RootHandler(layout, exits, testDomain, http.NewServeMux(), NewLocaleCache(testFiles, time.Hour))
+
+	w := serve(root, "GET", "/?lang=de")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != LangCookie || cookies[0].Value != "de" {
+		t.Fatalf("Expected a %s=de cookie, got %v", LangCookie, cookies)
+	}
+	if c := cookies[0]; c.SameSite != http.SameSiteStrictMode || c.MaxAge <= 0 || !c.HttpOnly || c.Path != "/" {
+		t.Errorf("Unexpected cookie attributes: %+v", c)
+	}
+
+	// a negotiated page mustn't be cached for other languages
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Language", "de")
+	w = httptest.NewRecorder()
+	root(w, r)
+	if w.Body.String() != "de" || !varies(w.Header(), "Accept-Language") {
+		t.Errorf("Expected a de page with Vary: Accept-Language, got %q %q", w.Body.String(), w.Header()["Vary"])
+	}
+
+	// the cookie carries the choice to a link without ?lang=
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	root(w, r)
+	if w.Body.String() != "de" || !varies(w.Header(), "Cookie") {
+		t.Errorf("Expected the page in de with Vary: Cookie, got %q %q", w.Body.String(), w.Header()["Vary"])
+	}
+
+	for _, target := range []string{"/", "/?lang=ja"} {
+		if cookies := serve(root, "GET", target).Result().Cookies(); len(cookies) != 0 {
+			t.Errorf("%s: didn't expect a cookie, got %v", target, cookies)
+		}
+	}
+}
+
+func TestHealthAndReady(t *testing.T) {
+	if w := serve(http.HandlerFunc(HealthHandler), "GET", "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Expected /healthz to be %d, got %d", http.StatusOK, w.Code)
+	}
+
+	files := fstest.MapFS{"data/langs": {Data: []byte(`[{"code": "de", "name": "German"}]`)}}
+	locales := NewLocaleCache(files, time.Hour)
+	c := NewConfigFS(testFiles)
+	rd := new(Readiness)
+	rd.Require("templates", c.TemplatesOK)
+	rd.Require("locales", locales.Loaded)
+	readyz := ReadyHandler(rd)
+
+	w := serve(readyz, "GET", "/readyz")
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "waiting for: templates, locales\n" {
+		t.Errorf("Expected to wait for everything, got %d %q", w.Code, w.Body.String())
+	}
+
+	// no locale directory yet, so only English
+	if _, err := c.Templated(testDomain, "index.html", func(*template.Template) http.HandlerFunc { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	locales.Refresh()
+	w = serve(readyz, "GET", "/readyz")
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "waiting for: locales\n" {
+		t.Errorf("Expected to wait for locales, got %d %q", w.Code, w.Body.String())
+	}
+
+	files["locale/de/torcheck.po"] = &fstest.MapFile{Data: []byte{}}
+	locales.Refresh()
+	if w = serve(readyz, "GET", "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("Expected ready, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestLocalesETag(t *testing.T) {
+	files := fstest.MapFS{}
+	for name, f := range testFiles {
+		files[name] = f
+	}
+	locales := NewLocaleCache(files, 5*time.Minute)
+	h := LocalesHandler(locales)
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/locales", nil)
+		if len(ifNoneMatch) > 0 {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	w := get("")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || len(etag) == 0 {
+		t.Fatalf("Expected 200 with an ETag, got %d %q", w.Code, etag)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=300" {
+		t.Errorf("Unexpected Cache-Control %q", cc)
+	}
+	var resp LocalesResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Locales["de"] != "German" || resp.SchemaVersion != APISchemaVersion {
+		t.Errorf("Unexpected body %s: %v", w.Body.String(), err)
+	}
+
+	for _, tag := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		if w := get(tag); w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("If-None-Match %s: expected an empty 304, got %d %q", tag, w.Code, w.Body.String())
+		}
+	}
+	if w := get(`"other"`); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a stale ETag, got %d", w.Code)
+	}
+
+	// a rescan that finds the same locales keeps the ETag
+	locales.Refresh()
+	if w := get(etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected the ETag to survive an unchanged rescan, got %d", w.Code)
+	}
+
+	files["data/langs"] = &fstest.MapFile{Data: []byte(`[{"code": "de", "name": "German"}, {"code": "xx", "name": "Unknown"}, {"code": "fr", "name": "French"}]`)}
+	files["locale/fr/torcheck.po"] = &fstest.MapFile{Data: []byte{}}
+	locales.Refresh()
+	if w := get(etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new ETag once the locales change, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Logger is what the server reports through. Replace Log to send the
+// output elsewhere, or to capture it in tests.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// StdLogger writes entries at or above Min to the standard log package,
+// so -log still decides where they go.
+type StdLogger struct {
+	Min Level
+}
+
+func (s StdLogger) logf(level Level, format string, v ...interface{}) {
+	if level >= s.Min {
+		log.Printf("level=%s %s", level, fmt.Sprintf(format, v...))
+	}
+}
+
+func (s StdLogger) Debugf(format string, v ...interface{}) { s.logf(LevelDebug, format, v...) }
+func (s StdLogger) Infof(format string, v ...interface{})  { s.logf(LevelInfo, format, v...) }
+func (s StdLogger) Warnf(format string, v ...interface{})  { s.logf(LevelWarn, format, v...) }
+func (s StdLogger) Errorf(format string, v ...interface{}) { s.logf(LevelError, format, v...) }
+
+// -debug lowers this to LevelDebug
+var Log Logger = StdLogger{Min: LevelInfo}
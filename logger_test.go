@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// keeps every entry as "level: message"
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *recordingLogger) record(level Level, format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, fmt.Sprintf("%s: %s", level, fmt.Sprintf(format, v...)))
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) { l.record(LevelDebug, format, v...) }
+func (l *recordingLogger) Infof(format string, v ...interface{})  { l.record(LevelInfo, format, v...) }
+func (l *recordingLogger) Warnf(format string, v ...interface{})  { l.record(LevelWarn, format, v...) }
+func (l *recordingLogger) Errorf(format string, v ...interface{}) { l.record(LevelError, format, v...) }
+
+func (l *recordingLogger) has(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if strings.HasPrefix(e, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func recordLogs(t *testing.T) *recordingLogger {
+	saved := Log
+	t.Cleanup(func() { Log = saved })
+	logs := new(recordingLogger)
+	Log = logs
+	return logs
+}
+
+func TestStdLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	l := StdLogger{Min: LevelWarn}
+	l.Infof("quiet")
+	l.Warnf("loud %d", 1)
+	if out := buf.String(); strings.Contains(out, "quiet") || !strings.Contains(out, "level=warn loud 1") {
+		t.Errorf("Unexpected output: %q", out)
+	}
+}
+
+func TestLogMissingName(t *testing.T) {
+	logs := recordLogs(t)
+	webLocales, err := FetchTranslationLocales(testFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetInstalledLocales(testFiles, webLocales, map[string]string{"de": "Deutsch"}); err != nil {
+		t.Fatal(err)
+	}
+	if !logs.has("warn: No translated name for code: xx") {
+		t.Errorf("Expected a warning for the missing name, got %q", logs.entries)
+	}
+	if logs.has("warn: No translated name for code: de") {
+		t.Errorf("Didn't expect a warning for a named locale, got %q", logs.entries)
+	}
+}
+
+func TestLogParseErrors(t *testing.T) {
+	logs := recordLogs(t)
+
+	// a broken language list falls back rather than exiting
+	fsys := fstest.MapFS{"data/langs": {Data: []byte(`[{"code": `)}}
+	if _, err := FetchTranslationLocales(fsys); err == nil {
+		t.Error("Expected a malformed data/langs to be an error")
+	}
+	if _, err := GetLocaleList(fsys); err != nil {
+		t.Errorf("Expected GetLocaleList to fall back, got %v", err)
+	}
+	if !logs.has("warn: Failed to get up to date language list") {
+		t.Errorf("Expected a warning for data/langs, got %q", logs.entries)
+	}
+	if _, err := GetInstalledLocales(fstest.MapFS{}, nil, nil); err == nil {
+		t.Error("Expected a missing locale directory to be an error")
+	}
+
+	// a template that no longer parses fails the request, not the server
+	broken := NewConfigFS(fstest.MapFS{"public/base.html": {Data: []byte(`{{ define "base.html" }}{{ end `)}})
+	broken.DevMode = true
+	h, err := broken.Templated(testDomain, "index.html", func(l *template.Template) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			WriteHTMLBuf(w, r, l, NullDomain(), "index.html", Page{})
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(h, "GET", "/"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if !logs.has("error: template=index.html CompileTemplate:") {
+		t.Errorf("Expected an error for the template, got %q", logs.entries)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Counter struct {
+	n uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.n)
+}
+
+// CounterVec is a set of counters told apart by one label value. Only
+// feed it values from a small, fixed set, like installed locales.
+type CounterVec struct {
+	mu       sync.RWMutex
+	counters map[string]*Counter
+}
+
+func (v *CounterVec) Inc(label string) {
+	v.mu.RLock()
+	c, ok := v.counters[label]
+	v.mu.RUnlock()
+	if !ok {
+		v.mu.Lock()
+		if v.counters == nil {
+			v.counters = make(map[string]*Counter)
+		}
+		if c, ok = v.counters[label]; !ok {
+			c = new(Counter)
+			v.counters[label] = c
+		}
+		v.mu.Unlock()
+	}
+	c.Inc()
+}
+
+func (v *CounterVec) Value(label string) uint64 {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if c, ok := v.counters[label]; ok {
+		return c.Value()
+	}
+	return 0
+}
+
+// Labels returns the label values seen so far, sorted.
+func (v *CounterVec) Labels() []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	labels := make([]string, 0, len(v.counters))
+	for label := range v.counters {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// upper bounds, in seconds, of the render time buckets
+var RenderBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Histogram counts observations into buckets with fixed upper bounds.
+type Histogram struct {
+	mu      sync.Mutex
+	Buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	s := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.Buckets))
+	}
+	for i, le := range h.Buckets {
+		if s <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+// writes name_bucket, name_sum and name_count, with cumulative buckets
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, le := range h.Buckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(le, 'f', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'f', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// counters exported in the Prometheus text format by MetricsHandler
+type Metrics struct {
+	TorChecks     Counter
+	NonTorChecks  Counter
+	LangFallbacks Counter
+	Scanners      Counter
+	Langs         CounterVec
+	RenderSeconds Histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{RenderSeconds: Histogram{Buckets: RenderBuckets}}
+}
+
+// what the handlers count into; tests swap in their own
+var Stats = NewMetrics()
+
+func (m *Metrics) CountCheck(isTor bool) {
+	if isTor {
+		m.TorChecks.Inc()
+	} else {
+		m.NonTorChecks.Inc()
+	}
+}
+
+// CountLang records a page served in lang, negotiated from source. Pages
+// in a fixed language, like the untranslated bulk list, have no source
+// and aren't counted.
+func (m *Metrics) CountLang(lang, source string) {
+	if len(source) == 0 {
+		return
+	}
+	if source == "default" {
+		m.LangFallbacks.Inc()
+	}
+	m.Langs.Inc(lang)
+}
+
+// MetricsHandler writes m and the size of the exit list in the Prometheus
+// exposition format, without pulling in the client library.
+func MetricsHandler(m *Metrics, Exits *Exits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintf(w, "# HELP check_requests_total Checks performed, by verdict.\n")
+		fmt.Fprintf(w, "# TYPE check_requests_total counter\n")
+		fmt.Fprintf(w, "check_requests_total{result=\"tor\"} %d\n", m.TorChecks.Value())
+		fmt.Fprintf(w, "check_requests_total{result=\"not_tor\"} %d\n", m.NonTorChecks.Value())
+		fmt.Fprintf(w, "# HELP check_exits Exit addresses currently counted as Tor.\n")
+		fmt.Fprintf(w, "# TYPE check_exits gauge\n")
+		fmt.Fprintf(w, "check_exits %d\n", len(Exits.IsTorLookup))
+		fmt.Fprintf(w, "# HELP check_scanner_requests_total Checks that looked like a crawler or scanner rather than a person.\n")
+		fmt.Fprintf(w, "# TYPE check_scanner_requests_total counter\n")
+		fmt.Fprintf(w, "check_scanner_requests_total %d\n", m.Scanners.Value())
+		fmt.Fprintf(w, "# HELP check_lang_fallbacks_total Pages served in en_US for lack of a requested language.\n")
+		fmt.Fprintf(w, "# TYPE check_lang_fallbacks_total counter\n")
+		fmt.Fprintf(w, "check_lang_fallbacks_total %d\n", m.LangFallbacks.Value())
+		fmt.Fprintf(w, "# HELP check_lang_total Requests by the language they were served in.\n")
+		fmt.Fprintf(w, "# TYPE check_lang_total counter\n")
+		for _, lang := range m.Langs.Labels() {
+			fmt.Fprintf(w, "check_lang_total{lang=%q} %d\n", lang, m.Langs.Value(lang))
+		}
+		fmt.Fprintf(w, "# HELP check_render_seconds Time spent executing page templates.\n")
+		fmt.Fprintf(w, "# TYPE check_render_seconds histogram\n")
+		m.RenderSeconds.write(w, "check_render_seconds")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var exposition = regexp.MustCompile(`^(# HELP [a-zA-Z_:][a-zA-Z0-9_:]* .*|# TYPE [a-zA-Z_:][a-zA-Z0-9_:]* (counter|gauge|histogram|summary|untyped)|[a-zA-Z_:][a-zA-Z0-9_:]*(\{([a-zA-Z_][a-zA-Z0-9_]*="[^"]*",?)*\})? -?[0-9.eE+]+|[a-zA-Z_:][a-zA-Z0-9_:]*(\{.*\})? \+Inf)$`)
+
+func scrape(t *testing.T, m *Metrics, e *Exits) map[string]string {
+	w := serve(MetricsHandler(m, e), "GET", "/metrics")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	samples := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		if !exposition.MatchString(line) {
+			t.Errorf("Invalid exposition line: %q", line)
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			i := strings.LastIndex(line, " ")
+			samples[line[:i]] = line[i+1:]
+		}
+	}
+	return samples
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := new(Metrics)
+	m.CountCheck(true)
+	m.CountCheck(false)
+	m.CountCheck(false)
+	m.LangFallbacks.Inc()
+	m.Scanners.Inc()
+	e := setupExitList(t, testExit)
+
+	expected := map[string]string{
+		`check_requests_total{result="tor"}`:     "1",
+		`check_requests_total{result="not_tor"}`: "2",
+		`check_exits`:                            "1",
+		`check_lang_fallbacks_total`:             "1",
+		`check_scanner_requests_total`:           "1",
+	}
+	samples := scrape(t, m, e)
+	for k, v := range expected {
+		if samples[k] != v {
+			t.Errorf("Expected %s to be %s, got %q", k, v, samples[k])
+		}
+	}
+}
+
+func TestMetricsFromRequests(t *testing.T) {
+	defer func(saved *Metrics) { Stats = saved }(Stats)
+	Stats = NewMetrics()
+
+	layout := template.Must(template.New("").Parse(`{{ define "index.html" }}{{ .Lang }}{{ end }}`))
+	e := setupExitList(t, testExit)
+	root := RootHandler(layout, e, testDomain, http.NewServeMux(), NewLocaleCache(testFiles, time.Hour))
+
+	for _, c := range []struct {
+		remoteAddr string
+		target     string
+	}{
+		{"91.121.43.80:1234", "/?lang=de"},
+		{"91.121.43.80:1234", "/"},
+		{"203.0.113.5:1234", "/?lang=de"},
+		{"203.0.113.5:1234", "/?lang=ja"},
+		{"203.0.113.5:1234", "/?format=json"},
+	} {
+		r := httptest.NewRequest("GET", c.target, nil)
+		r.RemoteAddr = c.remoteAddr
+		root(httptest.NewRecorder(), r)
+	}
+
+	expected := map[string]string{
+		`check_requests_total{result="tor"}`:     "2",
+		`check_requests_total{result="not_tor"}`: "3",
+		`check_lang_total{lang="de"}`:            "2",
+		`check_lang_total{lang="en_US"}`:         "2",
+		`check_lang_fallbacks_total`:             "2",
+		`check_scanner_requests_total`:           "5",
+		`check_render_seconds_bucket{le="+Inf"}`: "4",
+		`check_render_seconds_count`:             "4",
+	}
+	samples := scrape(t, Stats, e)
+	for k, v := range expected {
+		if samples[k] != v {
+			t.Errorf("Expected %s to be %s, got %q", k, v, samples[k])
+		}
+	}
+	if samples[`check_render_seconds_bucket{le="1"}`] != "4" {
+		t.Errorf("Expected every render in the 1s bucket, got %q", samples[`check_render_seconds_bucket{le="1"}`])
+	}
+}
+
+func TestLangCountsOnlyRenderedPages(t *testing.T) {
+	defer func(saved *Metrics) { Stats = saved }(Stats)
+	Stats = NewMetrics()
+
+	layout := template.Must(template.New("").Parse(`{{ define "bulk.html" }}{{ .Lang }}{{ end }}{{ define "index.html" }}{{ .Lang }}{{ end }}`))
+	e := setupExitList(t, testExit)
+	locales := NewLocaleCache(testFiles, time.Hour)
+	limiter := NewRateLimiter(1, 1)
+	limited := limiter.LimitChecks(testDomain, locales, RootHandler(layout, e, testDomain, http.NewServeMux(), locales))
+	get := func(h http.HandlerFunc, target string) int {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = "203.0.113.5:1234"
+		r.Header.Set("Accept-Language", "de")
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	bulk := BulkHandler(layout, e, testDomain)
+	for i := 0; i < 3; i++ {
+		if code := get(bulk, "/torbulkexitlist"); code != http.StatusOK {
+			t.Fatalf("Expected the bulk page, got %d", code)
+		}
+	}
+	// take the only token, then get limited
+	limiter.Allow("203.0.113.5")
+	if code := get(limited, "/"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected a 429, got %d", code)
+	}
+	if n := Stats.LangFallbacks.Value(); n != 0 || len(Stats.Langs.Labels()) != 0 {
+		t.Errorf("Expected no language counted, got %d fallbacks and %v", n, Stats.Langs.Labels())
+	}
+
+	// a rendered page counts once
+	get(RootHandler(layout, e, testDomain, http.NewServeMux(), locales), "/")
+	if Stats.Langs.Value("de") != 1 || Stats.LangFallbacks.Value() != 0 {
+		t.Errorf("Expected one page in de, got %v and %d fallbacks", Stats.Langs.Labels(), Stats.LangFallbacks.Value())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := Histogram{Buckets: []float64{0.01, 0.1}}
+	h.Observe(5 * time.Millisecond)
+	h.Observe(50 * time.Millisecond)
+	h.Observe(2 * time.Second)
+	buf := new(strings.Builder)
+	h.write(buf, "x")
+	expected := `x_bucket{le="0.01"} 1
+x_bucket{le="0.1"} 2
+x_bucket{le="+Inf"} 3
+x_sum 2.055
+x_count 3
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf)
+	}
+}
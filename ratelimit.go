@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"github.com/samuel/go-gettext/gettext"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket per client address. Each bucket holds up
+// to Burst requests and refills at Rate a second.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// how long an unused bucket takes to refill, after which it is no
+// different from a new one and can be dropped
+func (l *RateLimiter) idle() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// Allow takes a token from key's bucket. When it is empty, it returns
+// false and how long until the next token.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// drops full buckets, at most once per idle period, to bound memory
+func (l *RateLimiter) sweep(now time.Time) {
+	idle := l.idle()
+	if now.Sub(l.lastSweep) < idle {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= idle {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Limit answers 429 once a client runs out of tokens. Clients are told
+// apart by GetHost, so those behind a trusted proxy get their own bucket.
+// The body is translated into the client's language.
+func (l *RateLimiter) Limit(domain *gettext.Domain, Locales *LocaleCache, h http.HandlerFunc) http.HandlerFunc {
+	if domain == nil {
+		domain = NullDomain()
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := GetHost(r)
+		if err != nil {
+			key = r.RemoteAddr
+		}
+		ok, wait := l.Allow(key)
+		if ok {
+			h(w, r)
+			return
+		}
+		seconds := int(math.Ceil(wait.Seconds()))
+		lang := NegotiateLanguage(r, Locales.Get())
+		msg := domain.NGetText(lang, "Too many requests. Please try again in %d second.", "Too many requests. Please try again in %d seconds.", seconds)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		http.Error(w, fmt.Sprintf(msg, seconds), http.StatusTooManyRequests)
+	}
+}
+
+// LimitChecks is Limit for RootHandler, which serves the static files
+// too. Only the check itself, on "/", draws on the bucket, so a page
+// load costs one token however many assets it pulls in.
+func (l *RateLimiter) LimitChecks(domain *gettext.Domain, Locales *LocaleCache, h http.HandlerFunc) http.HandlerFunc {
+	limited := l.Limit(domain, Locales, h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) > 1 {
+			h(w, r)
+			return
+		}
+		limited(w, r)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"github.com/samuel/go-gettext/gettext"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	domain := &gettext.Domain{Languages: map[string]*gettext.Catalog{
+		"de": {Strings: map[string]*gettext.Translation{
+			"Too many requests. Please try again in %d second.": {
+				Plural:      "Too many requests. Please try again in %d seconds.",
+				Translation: []string{"Zu viele Anfragen. Bitte in %d Sekunde erneut versuchen.", "Zu viele Anfragen. Bitte in %d Sekunden erneut versuchen."},
+			},
+		}},
+	}}
+	SetPluralForms(domain)
+
+	now := time.Now()
+	limiter := NewRateLimiter(0.5, 2)
+	limiter.now = func() time.Time { return now }
+	h := limiter.Limit(domain, NewLocaleCache(testFiles, time.Hour), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	get := func(remoteAddr, xff, lang string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		if len(xff) > 0 {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		if len(lang) > 0 {
+			r.Header.Set("Accept-Language", lang)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	// two clients behind the same trusted proxy
+	for i := 0; i < 2; i++ {
+		if w := get("127.0.0.1:1234", "203.0.113.5", ""); w.Code != http.StatusNoContent {
+			t.Fatalf("Request %d: expected %d, got %d", i, http.StatusNoContent, w.Code)
+		}
+	}
+	w := get("127.0.0.1:1234", "203.0.113.5", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Expected 429 with Retry-After: 2, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if body := w.Body.String(); body != "Too many requests. Please try again in 2 seconds.\n" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if w := get("127.0.0.1:1234", "198.51.100.7", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected a separate bucket per forwarded client, got %d", w.Code)
+	}
+
+	now = now.Add(time.Second)
+	w = get("127.0.0.1:1234", "203.0.113.5", "de")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After: 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if body := w.Body.String(); body != "Zu viele Anfragen. Bitte in 1 Sekunde erneut versuchen.\n" {
+		t.Errorf("Unexpected localized body %q", body)
+	}
+
+	now = now.Add(time.Second)
+	if w := get("127.0.0.1:1234", "203.0.113.5", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected a token after the refill, got %d", w.Code)
+	}
+}
+
+func TestRateLimitEviction(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(1, 5)
+	limiter.now = func() time.Time { return now }
+	for _, key := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		limiter.Allow(key)
+	}
+	now = now.Add(limiter.idle())
+	limiter.Allow("203.0.113.4")
+	if len(limiter.buckets) != 1 {
+		keys := make([]string, 0, len(limiter.buckets))
+		for key := range limiter.buckets {
+			keys = append(keys, key)
+		}
+		t.Errorf("Expected idle buckets to be dropped, have %s", strings.Join(keys, ", "))
+	}
+}
+
+func TestRateLimitChecksOnly(t *testing.T) {
+	limiter := NewRateLimiter(0.5, 1)
+	h := limiter.LimitChecks(nil, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	get := func(target string) int {
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = "203.0.113.5:1234"
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+	if code := get("/"); code != http.StatusNoContent {
+		t.Fatalf("Expected the first check through, got %d", code)
+	}
+	for _, target := range []string{"/base.css", "/img/tor-on.png", "/torcheck/base.css"} {
+		if code := get(target); code != http.StatusNoContent {
+			t.Errorf("%s: expected static files not to be limited, got %d", target, code)
+		}
+	}
+	if code := get("/?lang=de"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second check to be limited, got %d", code)
+	}
+}
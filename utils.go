@@ -1,33 +1,258 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"github.com/samuel/go-gettext/gettext"
 	"html/template"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
+// SetLangCookie remembers lang for the pages that follow, which don't all
+// carry ?lang=.
+func SetLangCookie(w http.ResponseWriter, lang string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     LangCookie,
+		Value:    lang,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// IsParamSet reports whether the first value of param is non-empty, so
+// ?flag is unset but ?flag=%20 is set. New code should pick one of
+// IsParamPresent or IsParamNonBlank instead.
 func IsParamSet(r *http.Request, param string) bool {
 	return len(r.URL.Query().Get(param)) > 0
 }
 
-func Lang(r *http.Request) string {
-	lang := r.URL.Query().Get("lang")
-	if len(lang) == 0 {
-		lang = "en_US"
+// IsParamPresent reports whether param appears at all, even as ?flag or
+// ?flag=.
+func IsParamPresent(r *http.Request, param string) bool {
+	_, ok := r.URL.Query()[param]
+	return ok
+}
+
+// IsParamNonBlank reports whether any value of param has something other
+// than whitespace in it.
+func IsParamNonBlank(r *http.Request, param string) bool {
+	for _, v := range r.URL.Query()[param] {
+		if len(strings.TrimSpace(v)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// remembers a language picked with ?lang=
+const LangCookie = "lang"
+
+// LangSources are the places a page language can come from, strongest
+// first. Each gives the codes it asks for in its own order of preference.
+// Every code is matched by MatchLocale, so a regional fallback within one
+// source still beats the sources after it: ?lang=pt gets pt_BR even if
+// Accept-Language lists an exact match.
+var LangSources = []struct {
+	Name  string
+	Codes func(r *http.Request) []string
+}{
+	{"query", func(r *http.Request) []string {
+		return []string{r.URL.Query().Get("lang")}
+	}},
+	{"cookie", func(r *http.Request) []string {
+		if c, err := r.Cookie(LangCookie); err == nil {
+			return []string{c.Value}
+		}
+		return nil
+	}},
+	// ties in quality keep the header's order
+	{"accept-language", func(r *http.Request) []string {
+		return AcceptLanguageTags(r.Header.Get("Accept-Language"))
+	}},
+}
+
+// LangCandidate is one code a request asked for, and the installed
+// locale it matched, if any.
+type LangCandidate struct {
+	Source    string
+	Requested string
+	Matched   string
+}
+
+// LangCandidates lists every code r asks for, in LangSources order,
+// ending with the en_US default.
+func LangCandidates(r *http.Request, installed map[string]string) []LangCandidate {
+	var candidates []LangCandidate
+	for _, source := range LangSources {
+		for _, code := range source.Codes(r) {
+			if len(code) == 0 {
+				continue
+			}
+			candidates = append(candidates, LangCandidate{source.Name, code, MatchLocale(code, installed)})
+		}
+	}
+	return append(candidates, LangCandidate{"default", "en_US", "en_US"})
+}
+
+// NegotiateLanguage picks the one installed locale to serve r in: the
+// first of LangCandidates that matched. It counts nothing, since asking
+// isn't serving; WriteHTMLBuf counts the pages.
+func NegotiateLanguage(r *http.Request, installed map[string]string) string {
+	return negotiateLanguage(r, installed).Matched
+}
+
+func negotiateLanguage(r *http.Request, installed map[string]string) LangCandidate {
+	candidates := LangCandidates(r, installed)
+	var chosen LangCandidate
+	for _, c := range candidates {
+		if len(c.Matched) > 0 {
+			chosen = c
+			break
+		}
+	}
+	if Debug {
+		Log.Debugf("lang=%s source=%s candidates=%+v", chosen.Matched, chosen.Source, candidates)
+	}
+	return chosen
+}
+
+// AcceptLanguageTags returns the languages in an Accept-Language header
+// (e.g. "fr;q=0.9, en;q=0.8"), most preferred first. Entries with a
+// malformed quality value are skipped.
+func AcceptLanguageTags(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if len(tag) == 0 || tag == "*" {
+			continue
+		}
+		q, ok := 1.0, true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q >= 0 && q <= 1
+			}
+		}
+		if ok && q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+
+	codes := make([]string, len(tags))
+	for i, t := range tags {
+		codes[i] = t.tag
+	}
+	return codes
+}
+
+// AcceptLanguage returns the installed locale the header prefers most,
+// or "" if none match.
+func AcceptLanguage(header string, Locales map[string]string) string {
+	for _, tag := range AcceptLanguageTags(header) {
+		if code := MatchLocale(tag, Locales); len(code) > 0 {
+			return code
+		}
+	}
+	return ""
+}
+
+// the region each script subtag is usually written in, for codes like
+// zh-Hant that name a script instead of a region
+var scriptRegions = map[string]string{
+	"hans": "cn",
+	"hant": "tw",
+}
+
+// MatchLocale returns the installed locale closest to code: the exact
+// locale, then its base language, then a regional variant of that
+// language, so pt finds pt_BR and es_MX finds es. Of the variants, en_US
+// wins for en, and a script subtag picks its region, so zh-Hant finds
+// zh_TW; otherwise the first in sorted order does. It returns "" when
+// nothing is close.
+func MatchLocale(code string, Locales map[string]string) string {
+	if len(code) == 0 {
+		return ""
+	}
+	// locale codes are like pt_BR, where headers say pt-BR
+	code = strings.ToLower(strings.Replace(code, "-", "_", -1))
+	parts := strings.Split(code, "_")
+	base := parts[0]
+	preferred := ""
+	if base == "en" {
+		preferred = "en_us"
+	}
+	for _, part := range parts[1:] {
+		if region, ok := scriptRegions[part]; ok {
+			preferred = base + "_" + region
+		}
+	}
+
+	var exact, baseMatch, preferredMatch string
+	var variants []string
+	for installed := range Locales {
+		switch l := strings.ToLower(installed); {
+		case l == code:
+			exact = installed
+		case l == base:
+			baseMatch = installed
+		case l == preferred:
+			preferredMatch = installed
+		case strings.HasPrefix(l, base+"_"):
+			variants = append(variants, installed)
+		}
+	}
+	switch {
+	case len(exact) > 0:
+		return exact
+	case len(baseMatch) > 0:
+		return baseMatch
+	case len(preferredMatch) > 0:
+		return preferredMatch
+	case len(variants) > 0:
+		sort.Strings(variants)
+		return variants[0]
+	}
+	return ""
+}
+
+// ResolveLocale is MatchLocale, giving up on en_US.
+func ResolveLocale(code string, Locales map[string]string) string {
+	if lang := MatchLocale(code, Locales); len(lang) > 0 {
+		return lang
 	}
-	return lang
+	return "en_US"
 }
 
 func GetQS(q url.Values, param string, deflt int) (num int, str string) {
@@ -42,26 +267,338 @@ func GetQS(q url.Values, param string, deflt int) (num int, str string) {
 	return
 }
 
+// GetQSRange is GetQS with the parsed value clamped to [min, max]. The
+// returned fragment carries the clamped value, so links built from it
+// agree with what was served.
+func GetQSRange(q url.Values, param string, deflt, min, max int) (int, string) {
+	num, str := GetQSInt64(q, param, int64(deflt), int64(min), int64(max))
+	return int(num), str
+}
+
+// GetQSInt64 is GetQSRange for parameters that may not fit in an int.
+func GetQSInt64(q url.Values, param string, deflt, min, max int64) (num int64, str string) {
+	num, err := strconv.ParseInt(q.Get(param), 10, 64)
+	if err != nil {
+		// out of range still parses to the nearest bound
+		if ne, ok := err.(*strconv.NumError); !ok || ne.Err != strconv.ErrRange {
+			return deflt, ""
+		}
+	}
+	if num < min {
+		num = min
+	} else if num > max {
+		num = max
+	}
+	return num, fmt.Sprintf("&%s=%d", param, num)
+}
+
+// CollapseHops drops consecutive repeats of the same address, which
+// misconfigured proxy chains add to X-Forwarded-For.
+func CollapseHops(parts []string) []string {
+	hops := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if len(hops) > 0 && hops[len(hops)-1] == p {
+			continue
+		}
+		hops = append(hops, p)
+	}
+	return hops
+}
+
+// CanonicalIP strips any port, brackets and zone from addr and returns
+// the canonical form of the IP left, so it can be compared with the exit
+// list. Zones only mean something on the local link, so they're dropped.
+func CanonicalIP(addr string) (string, error) {
+	host := strings.TrimSpace(addr)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("invalid address %q", addr)
+	}
+	return ip.String(), nil
+}
+
+// proxies whose X-Forwarded-For we believe; set with -trusted. Anyone
+// else could claim to be any address at all.
+var TrustedProxies = parseCIDRs("127.0.0.0/8", "::1")
+
 func GetHost(r *http.Request) (host string, err error) {
 	// get remote ip
-	host = r.Header.Get("X-Forwarded-For")
-	if len(host) > 0 {
-		parts := strings.Split(host, ",")
-		// apache will append the remote address
-		host = strings.TrimSpace(parts[len(parts)-1])
-	} else {
-		host, _, err = net.SplitHostPort(r.RemoteAddr)
+	if host, err = CanonicalIP(r.RemoteAddr); err != nil {
+		return
+	}
+	xff := r.Header.Get("X-Forwarded-For")
+	if len(xff) == 0 || !inNets(host, TrustedProxies) {
+		return
+	}
+	// apache will append the remote address, so walk back from there
+	// to the first hop that isn't one of our proxies
+	hops := CollapseHops(strings.Split(xff, ","))
+	for i := len(hops) - 1; i >= 0; i-- {
+		if host, err = CanonicalIP(hops[i]); err != nil || !inNets(host, TrustedProxies) {
+			return
+		}
 	}
 	return
 }
 
-var TBBUserAgents = regexp.MustCompile(`^Mozilla/5\.0 \([^)]*\) Gecko/([\d]+\.0|20100101) Firefox/[\d]+\.0$`)
+var PrivateNets = parseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return nets
+}
+
+// ParseCIDRs parses networks like "10.0.0.0/8", treating a bare address
+// as a network of one. Blank entries are skipped, so -trusted "" trusts
+// nobody.
+func ParseCIDRs(cidrs []string) (nets []*net.IPNet, err error) {
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if len(c) == 0 {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func inNets(ip string, nets []*net.IPNet) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPrivateIP reports whether ip can't be the address of a real client,
+// including when it doesn't parse at all.
+func IsPrivateIP(ip string) bool {
+	return net.ParseIP(ip) == nil || inNets(ip, PrivateNets)
+}
+
+// how much of the client address we echo back
+type Redaction int
+
+const (
+	RedactNone Redaction = iota
+	RedactPartial
+	RedactFull
+)
+
+var IPRedaction = RedactNone
+
+func ParseRedaction(level string) (Redaction, error) {
+	switch level {
+	case "none":
+		return RedactNone, nil
+	case "partial":
+		return RedactPartial, nil
+	case "full":
+		return RedactFull, nil
+	}
+	return RedactNone, fmt.Errorf("unknown redaction level %q", level)
+}
+
+// RedactIP coarsens ip to its /24 (IPv4) or /48 (IPv6) for RedactPartial,
+// and drops it entirely for RedactFull.
+func RedactIP(ip string, level Redaction) string {
+	switch level {
+	case RedactPartial:
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return ""
+		}
+		if v4 := addr.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return addr.Mask(net.CIDRMask(48, 128)).String()
+	case RedactFull:
+		return ""
+	}
+	return ip
+}
+
+// Tor Browser reports a generic Windows, macOS or Linux platform;
+// distribution builds of Firefox (X11; Ubuntu; ...) don't match
+var TBBDesktopUserAgents = regexp.MustCompile(`^Mozilla/5\.0 \((Windows NT [\d.]+|Macintosh; Intel Mac OS X [\d._]+|X11; Linux [^;)]+)(; [^;)]+)*; rv:[\d.]+\) Gecko/([\d]+\.0|20100101) Firefox/(?P<version>[\d]+\.0)$`)
+
+// Tor Browser for Android hides the Android version or spoofs it as 9 or
+// 10, where Firefox reports the real one. Firefox on an old enough phone
+// is indistinguishable.
+var TBBAndroidUserAgents = regexp.MustCompile(`^Mozilla/5\.0 \(Android(?: (?:9|10))?; Mobile; rv:[\d.]+\) Gecko/([\d]+\.0|20100101) Firefox/(?P<version>[\d]+\.0)$`)
+
+var TBBUserAgents = []*regexp.Regexp{TBBDesktopUserAgents, TBBAndroidUserAgents}
+
+// extra patterns, loaded with -tbbua, for recognising new Tor Browser
+// releases before TBBUserAgents are updated
+var ExtraTBBUserAgents []*regexp.Regexp
+
+// LoadUserAgents reads one regular expression per line, skipping blank
+// lines and # comments.
+func LoadUserAgents(source io.Reader) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, scanner.Err()
+}
 
 func LikelyTBB(ua string) bool {
-	return TBBUserAgents.MatchString(ua)
+	_, ok := TBBVersion(ua)
+	return ok
+}
+
+// TBBVersion returns the Firefox version a likely Tor Browser reports.
+// Patterns loaded with -tbbua can supply one with a (?P<version>...) group.
+func TBBVersion(ua string) (string, bool) {
+	for _, patterns := range [][]*regexp.Regexp{TBBUserAgents, ExtraTBBUserAgents} {
+		for _, re := range patterns {
+			m := re.FindStringSubmatch(ua)
+			if m == nil {
+				continue
+			}
+			if i := re.SubexpIndex("version"); i > 0 {
+				return m[i], true
+			}
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// NullDomain has no catalogs, so every lookup returns the source string;
+// it stands in when translations can't be loaded.
+func NullDomain() *gettext.Domain {
+	return &gettext.Domain{Languages: make(map[string]*gettext.Catalog)}
+}
+
+// crawler and scanner signatures; -scannerua adds more
+var ScannerUserAgents = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bot|crawler|spider)\b`),
+	regexp.MustCompile(`(?i)\b(masscan|zgrab|nmap|nikto|sqlmap|nuclei|censys|l9explore)\b`),
+	regexp.MustCompile(`(?i)^(python-requests|python-urllib|go-http-client|libwww-perl|java)/`),
+}
+
+// LikelyScanner is a best-effort guess that r comes from a crawler or
+// scanner rather than a person. It must never feed into the Tor verdict.
+func LikelyScanner(r *http.Request) bool {
+	ua := r.UserAgent()
+	if len(ua) == 0 || len(r.Header.Get("Accept")) == 0 {
+		return true
+	}
+	for _, re := range ScannerUserAgents {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// languages written right to left, by base language
+var rtlLanguages = map[string]bool{
+	"ar": true, "ckb": true, "dv": true, "fa": true, "he": true, "iw": true,
+	"ps": true, "sd": true, "ug": true, "ur": true, "yi": true,
+}
+
+// Dir is the HTML dir attribute for lang, "rtl" or "ltr". Regional
+// variants follow their base language.
+func Dir(lang string) string {
+	base := strings.ToLower(lang)
+	if i := strings.IndexAny(base, "_-"); i > 0 {
+		base = base[:i]
+	}
+	if rtlLanguages[base] {
+		return "rtl"
+	}
+	return "ltr"
+}
+
+// LinkWith builds a relative link to target that keeps p's language and
+// small layout, then sets each key, value pair on top; an empty value
+// drops the key. target may already have a query string.
+func LinkWith(p Page, target string, kv ...string) (string, error) {
+	if len(kv)%2 != 0 {
+		return "", fmt.Errorf("LinkWith %s: odd number of key, value arguments", target)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if u.IsAbs() || len(u.Host) > 0 {
+		return "", fmt.Errorf("LinkWith %s: not a relative link", target)
+	}
+	q := u.Query()
+	if _, ok := q["lang"]; !ok && len(p.Lang) > 0 {
+		q.Set("lang", p.Lang)
+	}
+	if _, ok := q["small"]; !ok && p.Small {
+		q.Set("small", "1")
+	}
+	for i := 0; i < len(kv); i += 2 {
+		if len(kv[i+1]) == 0 {
+			q.Del(kv[i])
+		} else {
+			q.Set(kv[i], kv[i+1])
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
 }
 
 func FuncMap(domain *gettext.Domain) template.FuncMap {
+	if domain == nil {
+		domain = NullDomain()
+	}
 	return template.FuncMap{
 		"UnEscaped": func(x string) interface{} {
 			return template.HTML(x)
@@ -72,6 +609,11 @@ func FuncMap(domain *gettext.Domain) template.FuncMap {
 		"GetText": func(lang string, text string) string {
 			return domain.GetText(lang, text)
 		},
+		"NGetText": func(lang string, singular string, plural string, n int) string {
+			return domain.NGetText(lang, singular, plural, n)
+		},
+		"Dir":      Dir,
+		"LinkWith": LinkWith,
 		"Equal": func(one string, two string) bool {
 			return one == two
 		},
@@ -84,22 +626,222 @@ func FuncMap(domain *gettext.Domain) template.FuncMap {
 	}
 }
 
-var Layout *template.Template
+func (c *Config) parseLayout(domain *gettext.Domain) (*template.Template, error) {
+	files := make([]string, len(c.LayoutFiles))
+	for i, name := range c.LayoutFiles {
+		files[i] = path.Join("public", name)
+	}
+	return template.New("").Funcs(FuncMap(domain)).ParseFS(c.Files, files...)
+}
+
+// LayoutError is a CompileTemplate failure in the base layout, which
+// every page needs, rather than in the page itself.
+type LayoutError struct {
+	Err error
+}
 
-func CompileTemplate(base string, domain *gettext.Domain, templateName string) *template.Template {
-	if Layout == nil {
-		Layout = template.New("")
-		Layout = Layout.Funcs(FuncMap(domain))
-		Layout = template.Must(Layout.ParseFiles(
-			path.Join(base, "public/base.html"),
-			path.Join(base, "public/torbutton.html"),
-		))
+func (e *LayoutError) Error() string { return "base layout: " + e.Err.Error() }
+func (e *LayoutError) Unwrap() error { return e.Err }
+
+// CompileTemplate parses public/templateName on top of a copy of the base
+// layout, which is parsed once per Config unless DevMode is set. Errors
+// from the layout are a *LayoutError.
+func (c *Config) CompileTemplate(domain *gettext.Domain, templateName string) (*template.Template, error) {
+	var (
+		l   *template.Template
+		err error
+	)
+	if c.DevMode {
+		l, err = c.parseLayout(domain)
+	} else {
+		c.layoutOnce.Do(func() {
+			c.layout, c.layoutErr = c.parseLayout(domain)
+		})
+		l, err = c.layout, c.layoutErr
+		if err == nil {
+			l, err = l.Clone()
+		}
 	}
-	l, err := Layout.Clone()
 	if err != nil {
-		log.Fatal(err)
+		return nil, &LayoutError{err}
+	}
+	return l.ParseFS(c.Files, path.Join("public/", templateName))
+}
+
+// NewDomain loads the gettext catalogs under locale/ in fsys, the same
+// way gettext.NewDomain does from a directory on disk.
+func NewDomain(fsys fs.FS, name string) (*gettext.Domain, error) {
+	files, err := fs.Glob(fsys, path.Join("locale", "*", "LC_MESSAGES", name+".mo"))
+	if err != nil {
+		return nil, err
+	}
+	domain := &gettext.Domain{
+		Languages: make(map[string]*gettext.Catalog),
+	}
+	for _, f := range files {
+		b, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		langCode := strings.ToLower(strings.Split(f, "/")[1])
+		if domain.Languages[langCode], err = gettext.ParseMO(bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+	}
+	SetPluralForms(domain)
+	return domain, nil
+}
+
+// gettext's Plural-Forms rules by language, since the catalogs we load
+// assume English's n != 1
+var pluralForms = map[string]gettext.PluralFormula{
+	"ar": func(n int) int {
+		switch {
+		case n == 0:
+			return 0
+		case n == 1:
+			return 1
+		case n == 2:
+			return 2
+		case n%100 >= 3 && n%100 <= 10:
+			return 3
+		case n%100 >= 11:
+			return 4
+		}
+		return 5
+	},
+	"cs":    czechPlural,
+	"sk":    czechPlural,
+	"fa":    frenchPlural,
+	"fr":    frenchPlural,
+	"pt_br": frenchPlural,
+	"tr":    frenchPlural,
+	"ga": func(n int) int {
+		switch {
+		case n == 1:
+			return 0
+		case n == 2:
+			return 1
+		case n > 2 && n < 7:
+			return 2
+		case n > 6 && n < 11:
+			return 3
+		}
+		return 4
+	},
+	"is": func(n int) int {
+		if n%10 != 1 || n%100 == 11 {
+			return 1
+		}
+		return 0
+	},
+	"lt": func(n int) int {
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return 0
+		case n%10 >= 2 && (n%100 < 10 || n%100 >= 20):
+			return 1
+		}
+		return 2
+	},
+	"lv": func(n int) int {
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return 0
+		case n != 0:
+			return 1
+		}
+		return 2
+	},
+	"mk": func(n int) int {
+		if n == 1 || n%10 == 1 {
+			return 0
+		}
+		return 1
+	},
+	"pl": func(n int) int {
+		switch {
+		case n == 1:
+			return 0
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+			return 1
+		}
+		return 2
+	},
+	"ro": func(n int) int {
+		switch {
+		case n == 1:
+			return 0
+		case n == 0 || (n%100 > 0 && n%100 < 20):
+			return 1
+		}
+		return 2
+	},
+	"bs": slavicPlural,
+	"hr": slavicPlural,
+	"ru": slavicPlural,
+	"sr": slavicPlural,
+	"uk": slavicPlural,
+	"id": singularPlural,
+	"ja": singularPlural,
+	"ko": singularPlural,
+	"ms": singularPlural,
+	"th": singularPlural,
+	"vi": singularPlural,
+	"zh": singularPlural,
+}
+
+func czechPlural(n int) int {
+	switch {
+	case n == 1:
+		return 0
+	case n >= 2 && n <= 4:
+		return 1
+	}
+	return 2
+}
+
+func frenchPlural(n int) int {
+	if n > 1 {
+		return 1
+	}
+	return 0
+}
+
+func slavicPlural(n int) int {
+	switch {
+	case n%10 == 1 && n%100 != 11:
+		return 0
+	case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+		return 1
+	}
+	return 2
+}
+
+func singularPlural(n int) int {
+	return 0
+}
+
+// PluralFormula returns the plural rule for a locale code like "pt_BR",
+// trying the full code before its base language.
+func PluralFormula(langCode string) gettext.PluralFormula {
+	langCode = strings.ToLower(langCode)
+	if pf, ok := pluralForms[langCode]; ok {
+		return pf
+	}
+	if i := strings.Index(langCode, "_"); i > 0 {
+		if pf, ok := pluralForms[langCode[:i]]; ok {
+			return pf
+		}
+	}
+	return gettext.GermanicPluralFormula
+}
+
+// SetPluralForms gives every catalog in domain its language's plural rule.
+func SetPluralForms(domain *gettext.Domain) {
+	for langCode, c := range domain.Languages {
+		c.PluralFormula = PluralFormula(langCode)
 	}
-	return template.Must(l.ParseFiles(path.Join(base, "public/", templateName)))
 }
 
 type locale struct {
@@ -107,97 +849,202 @@ type locale struct {
 	Name string
 }
 
-func GetLocaleList(base string) map[string]string {
-	// populated from https://en.wikipedia.org/wiki/List_of_ISO_639-1_codes
-	// and https://en.wikipedia.org/w/api.php?action=sitematrix&format=json
-	haveTranslatedNames := map[string]string{
-		"ar":    "العربية",
-		"bg":    "български",
-		"bn":    "বাংলা",
-		"bs":    "Bosanski jezik",
-		"ca":    "Català",
-		"cs":    "Čeština",
-		"da":    "Dansk",
-		"de":    "Deutsch",
-		"el":    "ελληνικά",
-		"en_GB": "English (United Kingdom)",
-		"eo":    "Esperanto",
-		"es":    "Español",
-		"es_AR": "Español (Argentina)",
-		"es_MX": "Español (Mexico)",
-		"et":    "Eesti",
-		"eu":    "Euskara",
-		"fa":    "فارسی",
-		"fi":    "Suomi",
-		"fr":    "Français",
-		"ga":    "Gaeilge",
-		"he":    "עברית",
-		"hi":    "हिन्दी",
-		"hr":    "Hrvatski jezik",
-		"hr_HR": "Hrvatski jezik (Croatia)",
-		"hu":    "Magyar",
-		"id":    "Bahasa Indonesia",
-		"is":    "íslenska",
-		"it":    "Italiano",
-		"ja":    "日本語",
-		"ka":    "ქართული",
-		"ko":    "한국어",
-		"lt":    "lietuvių kalba",
-		"lv":    "Latviešu valoda",
-		"mk":    "македонски јазик",
-		"ms_MY": "Bahasa Melayu",
-		"nb":    "Norsk bokmål",
-		"nl":    "Nederlands",
-		"nl_BE": "Vlaams",
-		"nn":    "Norsk nynorsk",
-		"pa":    "ਪੰਜਾਬੀ",
-		"pl":    "Język polski",
-		"pt":    "Português",
-		"pt_BR": "Português brasileiro",
-		"pt_PT": "Português europeu",
-		"ro":    "română",
-		"ru":    "русский язык",
-		"sk":    "Slovenčina",
-		"sq":    "shqip",
-		"sr":    "српски језик",
-		"sv":    "Svenska",
-		"ta":    "தமிழ்",
-		"th":    "ไทย",
-		"tr":    "Türkçe",
-		"uk":    "українська мова",
-		"vi":    "Tiếng Việt",
-		"zh_CN": "中文简体",
-		"zh_HK": "中文繁體",
-		"zh_TW": "中文繁體",
+// LoadLocaleNames reads the native names we show for each locale from
+// data/locale-names.json, populated from
+// https://en.wikipedia.org/wiki/List_of_ISO_639-1_codes and
+// https://en.wikipedia.org/w/api.php?action=sitematrix&format=json
+// A missing or malformed file leaves us with no overrides.
+func LoadLocaleNames(fsys fs.FS) map[string]string {
+	names := make(map[string]string)
+	b, err := fs.ReadFile(fsys, "data/locale-names.json")
+	if err != nil {
+		Log.Warnf("No translated locale names: %v", err)
+		return names
+	}
+	var loaded map[string]string
+	if err = json.Unmarshal(b, &loaded); err != nil {
+		Log.Warnf("Ignoring malformed data/locale-names.json: %v", err)
+		return names
 	}
+	codes := make([]string, 0, len(loaded))
+	for code, name := range loaded {
+		// invalid UTF-8 in the file decodes to RuneError
+		if len(code) == 0 || len(strings.TrimSpace(name)) == 0 || strings.ContainsRune(name, utf8.RuneError) {
+			Log.Warnf("Ignoring invalid translated name for code: %q", code)
+			continue
+		}
+		names[code] = name
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	Log.Infof("Translated names for: %s", strings.Join(codes, ", "))
+	return names
+}
+
+func GetLocaleList(fsys fs.FS) (map[string]string, error) {
+	haveTranslatedNames := LoadLocaleNames(fsys)
 
 	// for all folders in locale which match a locale from https://www.transifex.com/api/2/languages/
 	// use the language name unless we have an override
-	webLocales, err := FetchTranslationLocales(base)
+	webLocales, err := FetchTranslationLocales(fsys)
+	if err != nil {
+		Log.Warnf("Failed to get up to date language list, using fallback: %v", err)
+		return haveTranslatedNames, nil
+	}
+
+	return GetInstalledLocales(fsys, webLocales, haveTranslatedNames)
+}
+
+// LocaleCache holds the result of GetLocaleList, so requests don't
+// rescan the locale directory. The first Get after TTL expires starts one
+// rescan in the background and, like every Get until it finishes, is
+// answered from the old list. A nil cache has no locales.
+type LocaleCache struct {
+	fsys fs.FS
+	TTL  time.Duration
+
+	// held for the length of a scan, so only one runs at a time
+	scan sync.Mutex
+
+	mu         sync.RWMutex
+	locales    map[string]string
+	loaded     bool
+	expires    time.Time
+	refreshing bool
+	now        func() time.Time
+
+	// the locales as served by /api/locales, redone only when they change
+	body []byte
+	etag string
+}
+
+var DefaultLocaleTTL = 5 * time.Minute
+
+func NewLocaleCache(fsys fs.FS, ttl time.Duration) *LocaleCache {
+	return &LocaleCache{fsys: fsys, TTL: ttl, now: time.Now}
+}
+
+func (c *LocaleCache) Get() map[string]string {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	locales := c.locales
+	stale := locales != nil && !c.now().Before(c.expires) && !c.refreshing
+	if stale {
+		c.refreshing = true
+	}
+	c.mu.Unlock()
+
+	// with nothing to serve yet, this request has to wait
+	if locales == nil {
+		return c.load()
+	}
+	if stale {
+		go c.Refresh()
+	}
+	return locales
+}
+
+// load scans unless another request already has while we waited.
+func (c *LocaleCache) load() map[string]string {
+	c.scan.Lock()
+	defer c.scan.Unlock()
+	c.mu.RLock()
+	locales := c.locales
+	c.mu.RUnlock()
+	if locales != nil {
+		return locales
+	}
+	return c.refresh()
+}
+
+// Refresh rescans the locales now, whether or not they have expired.
+func (c *LocaleCache) Refresh() map[string]string {
+	c.scan.Lock()
+	defer c.scan.Unlock()
+	return c.refresh()
+}
+
+// Loaded reports whether a scan has ever succeeded, rather than falling
+// back to English.
+func (c *LocaleCache) Loaded() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.loaded
+}
+
+// refresh scans without holding mu, so Get keeps answering meanwhile.
+// A failed rescan keeps the locales we already had.
+func (c *LocaleCache) refresh() map[string]string {
+	locales, err := GetLocaleList(c.fsys)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err == nil:
+		c.set(locales)
+		c.loaded = true
+	case c.locales == nil:
+		Log.Errorf("Serving English only: %v", err)
+		c.set(map[string]string{"en_US": "English"})
+	default:
+		Log.Errorf("Keeping the previous locales: %v", err)
+	}
+	c.expires = c.now().Add(c.TTL)
+	c.refreshing = false
+	return c.locales
+}
+
+func (c *LocaleCache) set(locales map[string]string) {
+	if c.body != nil && reflect.DeepEqual(locales, c.locales) {
+		return
+	}
+	c.locales = locales
+	// maps marshal with sorted keys, so equal lists hash the same
+	body, err := json.Marshal(LocalesResp{APISchemaVersion, locales})
 	if err != nil {
-		log.Printf("Failed to get up to date language list, using fallback.")
-		return haveTranslatedNames
+		Log.Errorf("Marshalling locales: %v", err)
+		return
 	}
+	sum := sha256.Sum256(body)
+	c.body, c.etag = body, fmt.Sprintf(`"%x"`, sum[:12])
+}
 
-	return GetInstalledLocales(base, webLocales, haveTranslatedNames)
+// JSON returns the locales as /api/locales serves them, and their ETag.
+func (c *LocaleCache) JSON() ([]byte, string) {
+	c.Get()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.body, c.etag
 }
 
-func FetchTranslationLocales(base string) (map[string]locale, error) {
-	file, err := os.Open(path.Join(base, "data/langs"))
+func FetchTranslationLocales(fsys fs.FS) (map[string]locale, error) {
+	file, err := fsys.Open("data/langs")
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	webLocales, err := decodeLocales(file)
+	if err != nil {
+		return nil, fmt.Errorf("data/langs: %v", err)
+	}
+	return webLocales, nil
+}
+
+func decodeLocales(source io.Reader) (map[string]locale, error) {
 	webLocales := make(map[string]locale)
 	// Parse the api response into a list of possible locales
-	dec := json.NewDecoder(file)
+	dec := json.NewDecoder(source)
 	for {
 		var webList []locale
-		if err = dec.Decode(&webList); err == io.EOF {
+		if err := dec.Decode(&webList); err == io.EOF {
 			break
 		} else if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
 		// The api returns an array, so we need to map it
@@ -205,27 +1052,218 @@ func FetchTranslationLocales(base string) (map[string]locale, error) {
 			webLocales[l.Code] = l
 		}
 	}
+	return webLocales, nil
+}
 
+// the language list is well under this; anything bigger isn't it
+const maxLangsSize = 1 << 20
+
+// FetchRemoteLocales gets the language list from url, giving up when ctx
+// is done. On success it replaces cachePath with what it fetched, by
+// renaming a complete copy over it, so readers never see half a file.
+// On failure it falls back to data/langs in fsys.
+func FetchRemoteLocales(ctx context.Context, url string, cachePath string, fsys fs.FS) (map[string]locale, error) {
+	body, webLocales, err := getLocales(ctx, url)
+	if err != nil {
+		Log.Warnf("Fetching %s, using data/langs: %v", url, err)
+		return FetchTranslationLocales(fsys)
+	}
+	if len(cachePath) > 0 {
+		if err = writeAtomic(cachePath, body); err != nil {
+			Log.Warnf("Caching the language list: %v", err)
+		}
+	}
 	return webLocales, nil
 }
 
+func getLocales(ctx context.Context, url string) ([]byte, map[string]locale, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxLangsSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	webLocales, err := decodeLocales(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(webLocales) == 0 {
+		return nil, nil, fmt.Errorf("no languages listed")
+	}
+	return body, webLocales, nil
+}
+
+func writeAtomic(name string, data []byte) error {
+	// an embedded build may not have the directory yet
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// RefreshLocales fetches the language list from url every interval, each
+// attempt bounded by timeout, keeping cachePath up to date for the next
+// locale scan. It runs apart from requests, which only ever read the
+// cached copy.
+func RefreshLocales(url string, timeout time.Duration, interval time.Duration, cachePath string, fsys fs.FS) {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		FetchRemoteLocales(ctx, url, cachePath, fsys)
+		cancel()
+		time.Sleep(interval)
+	}
+}
+
+// ParsePO reads the msgid to msgstr pairs from a .po or .pot file. For
+// plurals msgstr is the singular translation, and fuzzy entries count as
+// untranslated, as they do for msgfmt. The header is dropped.
+func ParsePO(source io.Reader) (map[string]string, error) {
+	entries := make(map[string]string)
+	var msgid, msgstr *string
+	var id, str string
+	// seen tells a following msgid or flag line that this entry is done
+	fuzzy, seen := false, false
+	flush := func() {
+		if len(id) > 0 {
+			if fuzzy {
+				str = ""
+			}
+			entries[id] = str
+		}
+		id, str, fuzzy, seen = "", "", false, false
+		msgid, msgstr = nil, nil
+	}
+
+	scanner := bufio.NewScanner(source)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var field string
+		switch {
+		case len(line) == 0:
+			continue
+		case strings.HasPrefix(line, "#,"):
+			if seen {
+				flush()
+			}
+			fuzzy = fuzzy || strings.Contains(line, "fuzzy")
+			continue
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "msgid "):
+			if seen {
+				flush()
+			}
+			msgid, field = &id, line[len("msgid "):]
+		case strings.HasPrefix(line, "msgid_plural "):
+			// the singular msgid is what we look up
+			msgid = nil
+			continue
+		case strings.HasPrefix(line, "msgstr[0] "):
+			msgid, msgstr, field, seen = nil, &str, line[len("msgstr[0] "):], true
+		case strings.HasPrefix(line, "msgstr["):
+			msgid, msgstr = nil, nil
+			continue
+		case strings.HasPrefix(line, "msgstr "):
+			msgid, msgstr, field, seen = nil, &str, line[len("msgstr "):], true
+		case strings.HasPrefix(line, `"`):
+			field = line
+		default:
+			return nil, fmt.Errorf("unexpected line: %q", line)
+		}
+
+		// continuation lines add to whichever string came before
+		part, err := strconv.Unquote(field)
+		if err != nil {
+			return nil, fmt.Errorf("bad string %s: %v", field, err)
+		}
+		switch {
+		case msgid != nil:
+			*msgid += part
+		case msgstr != nil:
+			*msgstr += part
+		}
+	}
+	flush()
+	return entries, scanner.Err()
+}
+
+// Coverage is the fraction of msgids in template that translated gives a
+// msgstr for, out of those translated lists at all. Strings added to
+// check.pot since the .po was last synced aren't held against it, since
+// translators haven't been able to see them yet.
+func Coverage(template, translated map[string]string) float64 {
+	if len(template) == 0 {
+		return 1
+	}
+	listed, done := 0, 0
+	for msgid := range template {
+		msgstr, ok := translated[msgid]
+		if !ok {
+			continue
+		}
+		listed++
+		if len(msgstr) > 0 {
+			done++
+		}
+	}
+	if listed == 0 {
+		return 0
+	}
+	return float64(done) / float64(listed)
+}
+
+// the fraction of its strings a locale has to translate to be listed;
+// set by -mincoverage
+var MinCoverage = 1.0
+
+func readPO(fsys fs.FS, name string) (map[string]string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePO(f)
+}
+
 // Get a list of all languages installed in our locale folder with translations if available
-func GetInstalledLocales(base string, webLocales map[string]locale, nameTranslations map[string]string) map[string]string {
-	localFiles, err := ioutil.ReadDir(path.Join(base, "locale"))
+func GetInstalledLocales(fsys fs.FS, webLocales map[string]locale, nameTranslations map[string]string) (map[string]string, error) {
+	localFiles, err := fs.ReadDir(fsys, "locale")
 
 	if err != nil {
-		log.Print("No locales found in 'locale'. Try running 'make i18n'.")
-		log.Fatal(err)
+		return nil, fmt.Errorf("no locales found, try running 'make i18n': %v", err)
+	}
+
+	template, err := readPO(fsys, "check.pot")
+	if err != nil {
+		Log.Warnf("Not checking translation coverage: %v", err)
 	}
 
 	locales := make(map[string]string, len(localFiles))
 	locales["en_US"] = "English"
 
 	for _, f := range localFiles {
-		// TODO: Ensure a language has 100% of the template file
-		// Currently this is what should be on the torcheck_completed
-		// branch on the translations git should be, so we don't really
-		// have to check it in theory...
 		code := f.Name()
 
 		// Only accept folders which have corresponding locale
@@ -233,14 +1271,27 @@ func GetInstalledLocales(base string, webLocales map[string]locale, nameTranslat
 			continue
 		}
 
+		// Partial translations would show a mix of languages
+		if template != nil {
+			translated, err := readPO(fsys, path.Join("locale", code, "torcheck.po"))
+			if err != nil {
+				Log.Warnf("Skipping locale %s: %v", code, err)
+				continue
+			}
+			if c := Coverage(template, translated); c < MinCoverage {
+				Log.Infof("Skipping locale %s: %.0f%% translated", code, c*100)
+				continue
+			}
+		}
+
 		// If we have a translated name for a given locale, use it
 		if transName := nameTranslations[code]; transName != "" {
 			locales[code] = transName
 		} else {
-			log.Print("No translated name for code: " + code)
+			Log.Warnf("No translated name for code: %s", code)
 			locales[code] = webLocales[code].Name
 		}
 	}
 
-	return locales
+	return locales, nil
 }
@@ -1,6 +1,29 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"github.com/samuel/go-gettext/gettext"
+	"html/template"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
 
 var UserAgents = map[string]bool{
 	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.8; rv:10.0.2) Gecko/20100101 Firefox/10.0.2":                                    false,
@@ -20,6 +43,37 @@ var UserAgents = map[string]bool{
 	"Mozilla/5.0 (Android 9; Mobile; rv:78.0) Gecko/78.0 Firefox/78.0":                                                         true,
 }
 
+func TestTBBDesktopAndAndroid(t *testing.T) {
+	cases := []struct {
+		ua      string
+		desktop bool
+		android bool
+	}{
+		// Tor Browser
+		{"Mozilla/5.0 (Windows NT 10.0; rv:115.0) Gecko/20100101 Firefox/115.0", true, false},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0", true, false},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", true, false},
+		{"Mozilla/5.0 (Android 10; Mobile; rv:115.0) Gecko/115.0 Firefox/115.0", false, true},
+		{"Mozilla/5.0 (Android; Mobile; rv:52.0) Gecko/20100101 Firefox/52.0", false, true},
+		// Firefox
+		{"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", false, false},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:130.0) Gecko/20100101 Firefox/130.0.1", false, false},
+		{"Mozilla/5.0 (Android 14; Mobile; rv:128.0) Gecko/128.0 Firefox/128.0", false, false},
+		{"Mozilla/5.0 (Android 13; Tablet; rv:128.0) Gecko/128.0 Firefox/128.0", false, false},
+	}
+	for _, c := range cases {
+		if got := TBBDesktopUserAgents.MatchString(c.ua); got != c.desktop {
+			t.Errorf("%q: desktop match %t, expected %t", c.ua, got, c.desktop)
+		}
+		if got := TBBAndroidUserAgents.MatchString(c.ua); got != c.android {
+			t.Errorf("%q: android match %t, expected %t", c.ua, got, c.android)
+		}
+		if got := LikelyTBB(c.ua); got != (c.desktop || c.android) {
+			t.Errorf("%q: LikelyTBB %t", c.ua, got)
+		}
+	}
+}
+
 func TestLikelyTBB(t *testing.T) {
 	for k, v := range UserAgents {
 		if LikelyTBB(k) != v {
@@ -27,3 +81,1110 @@ func TestLikelyTBB(t *testing.T) {
 		}
 	}
 }
+
+func TestTBBVersion(t *testing.T) {
+	cases := []struct {
+		ua      string
+		version string
+		ok      bool
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; rv:115.0) Gecko/20100101 Firefox/115.0", "115.0", true},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0", "128.0", true},
+		{"Mozilla/5.0 (Windows NT 6.1; rv:24.0) Gecko/20100101 Firefox/24.0", "24.0", true},
+		{"Mozilla/5.0 (Android 9; Mobile; rv:78.0) Gecko/78.0 Firefox/78.0", "78.0", true},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_8_4) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/27.0.1453.110 Safari/537.36", "", false},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.8; rv:10.0.2) Gecko/20100101 Firefox/10.0.2", "", false},
+	}
+	for _, c := range cases {
+		version, ok := TBBVersion(c.ua)
+		if version != c.version || ok != c.ok {
+			t.Errorf("%q: got (%q, %t), expected (%q, %t)", c.ua, version, ok, c.version, c.ok)
+		}
+		if ok != LikelyTBB(c.ua) {
+			t.Errorf("%q: TBBVersion and LikelyTBB disagree", c.ua)
+		}
+	}
+
+	defer func() { ExtraTBBUserAgents = nil }()
+	ExtraTBBUserAgents, _ = LoadUserAgents(strings.NewReader("TorBrowserNext/(?P<version>[\\d.]+)$\nNoVersion$\n"))
+	if version, ok := TBBVersion("Mozilla/5.0 TorBrowserNext/14.5"); version != "14.5" || !ok {
+		t.Errorf("Expected the version from a configured pattern, got (%q, %t)", version, ok)
+	}
+	if version, ok := TBBVersion("Mozilla/5.0 NoVersion"); version != "" || !ok {
+		t.Errorf("Expected a match without a version, got (%q, %t)", version, ok)
+	}
+}
+
+func TestExtraTBBUserAgents(t *testing.T) {
+	ua := "Mozilla/5.0 (Windows NT 10.0; rv:999.0) Gecko/20100101 Firefox/999.0 TorBrowserNext"
+	if LikelyTBB(ua) {
+		t.Fatalf("Expected \"%s\" not to match before it is configured", ua)
+	}
+
+	patterns, err := LoadUserAgents(strings.NewReader("# upcoming release\n\nTorBrowserNext$\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExtraTBBUserAgents = patterns
+	defer func() { ExtraTBBUserAgents = nil }()
+
+	if !LikelyTBB(ua) {
+		t.Errorf("Expected \"%s\" to match the configured pattern", ua)
+	}
+	// the built-in patterns still apply
+	TestLikelyTBB(t)
+
+	if _, err := LoadUserAgents(strings.NewReader("(unclosed")); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+}
+
+func TestCollapseHops(t *testing.T) {
+	hops := CollapseHops(strings.Split("1.1.1.1, 2.2.2.2,2.2.2.2 , 2.2.2.2, 3.3.3.3, 1.1.1.1", ","))
+	expected := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "1.1.1.1"}
+	if !reflect.DeepEqual(hops, expected) {
+		t.Errorf("Expected %v, got %v", expected, hops)
+	}
+}
+
+func TestParamChecks(t *testing.T) {
+	cases := []struct {
+		query    string
+		set      bool
+		present  bool
+		nonBlank bool
+	}{
+		{"", false, false, false},
+		{"?other=1", false, false, false},
+		{"?flag", false, true, false},
+		{"?flag=", false, true, false},
+		{"?flag=%20", true, true, false},
+		{"?flag=+%09", true, true, false},
+		{"?flag=1", true, true, true},
+		{"?flag=&flag=1", false, true, true},
+		{"?flag=1&flag=", true, true, true},
+		{"?flag=%20&flag=%20", true, true, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/"+c.query, nil)
+		if got := IsParamSet(r, "flag"); got != c.set {
+			t.Errorf("IsParamSet(%q) = %t", c.query, got)
+		}
+		if got := IsParamPresent(r, "flag"); got != c.present {
+			t.Errorf("IsParamPresent(%q) = %t", c.query, got)
+		}
+		if got := IsParamNonBlank(r, "flag"); got != c.nonBlank {
+			t.Errorf("IsParamNonBlank(%q) = %t", c.query, got)
+		}
+	}
+}
+
+func TestGetQSRange(t *testing.T) {
+	cases := []struct {
+		query string
+		num   int
+		str   string
+	}{
+		{"port=443", 443, "&port=443"},
+		{"port=0", 1, "&port=1"},
+		{"port=-80", 1, "&port=1"},
+		{"port=999999999", 65535, "&port=65535"},
+		{"port=99999999999999999999999", 65535, "&port=65535"},
+		{"port=https", 80, ""},
+		{"port=", 80, ""},
+		{"", 80, ""},
+	}
+	for _, c := range cases {
+		q, _ := url.ParseQuery(c.query)
+		num, str := GetQSRange(q, "port", 80, 1, 65535)
+		if num != c.num || str != c.str {
+			t.Errorf("%q: got (%d, %q), expected (%d, %q)", c.query, num, str, c.num, c.str)
+		}
+	}
+
+	q := url.Values{"since": {"1700000000000"}}
+	if num, str := GetQSInt64(q, "since", 0, 0, math.MaxInt64); num != 1700000000000 || str != "&since=1700000000000" {
+		t.Errorf("Expected an int64 to pass through, got (%d, %q)", num, str)
+	}
+}
+
+func TestGetHost(t *testing.T) {
+	cases := []struct {
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		{"91.121.43.80:1234", "", "91.121.43.80"},
+		{"[2001:db8::1]:443", "", "2001:db8::1"},
+		{"[2001:0db8:0000::0001]:443", "", "2001:db8::1"},
+		{"[fe80::1%eth0]:443", "", "fe80::1"},
+		{"127.0.0.1:80", "91.121.43.80", "91.121.43.80"},
+		{"127.0.0.1:80", "10.0.0.1, 2001:DB8::1", "2001:db8::1"},
+		{"127.0.0.1:80", "[2001:db8::1]", "2001:db8::1"},
+		{"127.0.0.1:80", "[2001:db8::1]:443", "2001:db8::1"},
+		{"127.0.0.1:80", "10.0.0.1, fe80::1%eth0", "fe80::1"},
+		{"127.0.0.1:80", "::ffff:91.121.43.80", "91.121.43.80"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if len(c.xff) > 0 {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if host, err := GetHost(r); err != nil || host != c.expected {
+			t.Errorf("GetHost(%q, %q) = %q (%v), expected %q", c.remoteAddr, c.xff, host, err, c.expected)
+		}
+	}
+
+	for _, xff := range []string{"not-an-ip", "91.121.43.80, ", "2001:db8::zz"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "127.0.0.1:80"
+		r.Header.Set("X-Forwarded-For", xff)
+		if host, err := GetHost(r); err == nil {
+			t.Errorf("Expected X-Forwarded-For %q to be rejected, got %q", xff, host)
+		}
+	}
+}
+
+func TestGetHostDuplicateHops(t *testing.T) {
+	defer func(saved []*net.IPNet) { TrustedProxies = saved }(TrustedProxies)
+	TrustedProxies = parseCIDRs("127.0.0.1", "10.0.0.0/8")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:80"
+	r.Header.Set("X-Forwarded-For", "91.121.43.80, 91.121.43.80, 10.0.0.1, 10.0.0.1")
+	if host, err := GetHost(r); err != nil || host != "91.121.43.80" {
+		t.Errorf("Expected 91.121.43.80, got %q (%v)", host, err)
+	}
+}
+
+func TestGetHostTrustedProxies(t *testing.T) {
+	defer func(saved []*net.IPNet) { TrustedProxies = saved }(TrustedProxies)
+	TrustedProxies = parseCIDRs("127.0.0.1", "10.0.0.0/8", "2001:db8::/32")
+
+	cases := []struct {
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		// a client talking to us directly can't claim another address
+		{"203.0.113.5:1234", "91.121.43.80", "203.0.113.5"},
+		// nor can it by prepending to what our proxy appends
+		{"127.0.0.1:80", "91.121.43.80, 203.0.113.5", "203.0.113.5"},
+		// our own proxies are skipped
+		{"127.0.0.1:80", "91.121.43.80, 10.1.1.1", "91.121.43.80"},
+		{"127.0.0.1:80", "91.121.43.80, [2001:db8::1]:80, 10.1.1.1", "91.121.43.80"},
+		// if every hop is trusted we take the furthest one
+		{"127.0.0.1:80", "10.2.2.2, 10.1.1.1", "10.2.2.2"},
+		{"[2001:db8::2]:80", "91.121.43.80", "91.121.43.80"},
+		{"127.0.0.1:80", "", "127.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		if len(c.xff) > 0 {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if host, err := GetHost(r); err != nil || host != c.expected {
+			t.Errorf("GetHost(%q, %q) = %q (%v), expected %q", c.remoteAddr, c.xff, host, err, c.expected)
+		}
+	}
+
+	if _, err := ParseCIDRs([]string{"10.0.0.0/8", "bogus"}); err == nil {
+		t.Error("Expected an invalid network to be rejected")
+	}
+
+	// -trusted "" turns X-Forwarded-For off
+	nets, err := ParseCIDRs(strings.Split("", ","))
+	if err != nil || len(nets) != 0 {
+		t.Fatalf("Expected an empty list to trust nobody, got %v (%v)", nets, err)
+	}
+	TrustedProxies = nets
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:80"
+	r.Header.Set("X-Forwarded-For", "91.121.43.80")
+	if host, err := GetHost(r); err != nil || host != "127.0.0.1" {
+		t.Errorf("Expected X-Forwarded-For to be ignored, got %q (%v)", host, err)
+	}
+}
+
+var testFiles = fstest.MapFS{
+	"public/base.html":      {Data: []byte(`{{ define "base.html" }}<title>{{ template "title" . }}</title>{{ end }}`)},
+	"public/torbutton.html": {Data: []byte(`{{ define "torbutton.html" }}{{ .IsTor }}{{ end }}`)},
+	"public/index.html":     {Data: []byte(`{{ define "index.html" }}{{ template "base.html" . }}{{ end }}{{ define "title" }}{{ .IP }}{{ end }}`)},
+	"data/langs":            {Data: []byte(`[{"code": "de", "name": "German"}, {"code": "xx", "name": "Unknown"}]`)},
+	"locale/de/torcheck.po": {Data: []byte{}},
+	"locale/xx/torcheck.po": {Data: []byte{}},
+	"locale/templates":      {Data: []byte{}},
+}
+
+// writes fsys out to a temporary directory so it can be read back from disk
+func onDisk(t *testing.T, fsys fs.FS) fs.FS {
+	return os.DirFS(writeFiles(t, fsys))
+}
+
+func writeFiles(t *testing.T, fsys fs.FS) string {
+	dir := t.TempDir()
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(dest, b, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLocaleListFS(t *testing.T) {
+	for name, fsys := range map[string]fs.FS{"embedded": testFiles, "disk": onDisk(t, testFiles)} {
+		webLocales, err := FetchTranslationLocales(fsys)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		locales, err := GetInstalledLocales(fsys, webLocales, map[string]string{"de": "Deutsch"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		expected := map[string]string{"en_US": "English", "de": "Deutsch", "xx": "Unknown"}
+		if !reflect.DeepEqual(locales, expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, locales)
+		}
+	}
+}
+
+var testTemplate = `msgid ""
+msgstr ""
+"Content-Type: text/plain; charset=utf-8\n"
+
+msgid "Congratulations. This browser is configured to use Tor."
+msgstr ""
+
+msgid ""
+"If you are attempting to use a Tor client, please refer to the <a href="
+"\"https://www.torproject.org/\">Tor website</a>."
+msgstr ""
+
+msgid "One exit"
+msgid_plural "%d exits"
+msgstr[0] ""
+msgstr[1] ""
+
+msgid "Volunteer"
+msgstr ""
+`
+
+func TestFetchRemoteLocales(t *testing.T) {
+	const onDiskLangs = `[{"code": "de", "name": "German"}]`
+	const remoteLangs = `[{"code": "de", "name": "German"}, {"code": "fr", "name": "French"}]`
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, remoteLangs)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, remoteLangs)
+	})
+	mux.HandleFunc("/malformed", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[{"code": "fr", `)
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cases := []struct {
+		path     string
+		timeout  time.Duration
+		expected []string
+		cached   string
+	}{
+		{"/ok", time.Second, []string{"de", "fr"}, remoteLangs},
+		{"/slow", 50 * time.Millisecond, []string{"de"}, onDiskLangs},
+		{"/malformed", time.Second, []string{"de"}, onDiskLangs},
+		{"/missing", time.Second, []string{"de"}, onDiskLangs},
+	}
+	for _, c := range cases {
+		dir := writeFiles(t, fstest.MapFS{"data/langs": {Data: []byte(onDiskLangs)}})
+		cachePath := filepath.Join(dir, "data", "langs")
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		start := time.Now()
+		webLocales, err := FetchRemoteLocales(ctx, server.URL+c.path, cachePath, os.DirFS(dir))
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+			continue
+		}
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("%s: took %v, past the deadline", c.path, took)
+		}
+		var codes []string
+		for code := range webLocales {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		if !reflect.DeepEqual(codes, c.expected) {
+			t.Errorf("%s: expected %v, got %v", c.path, c.expected, codes)
+		}
+		if b, _ := os.ReadFile(cachePath); string(b) != c.cached {
+			t.Errorf("%s: expected data/langs to hold %s, got %s", c.path, c.cached, b)
+		}
+		if entries, _ := os.ReadDir(filepath.Dir(cachePath)); len(entries) != 1 {
+			t.Errorf("%s: expected no temporary files left behind, got %d entries", c.path, len(entries))
+		}
+	}
+}
+
+func TestParsePO(t *testing.T) {
+	entries, err := ParsePO(strings.NewReader(`msgid ""
+msgstr ""
+"Language: de\n"
+
+#: index.html
+msgid "Volunteer"
+msgstr "Freiwillige"
+
+#, fuzzy
+msgid "One exit"
+msgid_plural "%d exits"
+msgstr[0] "Ein Ausgang"
+msgstr[1] "%d Ausgänge"
+
+msgid ""
+"If you are attempting to use a Tor client, please refer to the <a href="
+"\"https://www.torproject.org/\">Tor website</a>."
+msgstr ""
+"Wenn Sie versuchen, einen Tor-Client zu nutzen, besuchen Sie die <a href="
+"\"https://www.torproject.org/\">Tor-Website</a>."
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"Volunteer": "Freiwillige",
+		"One exit":  "",
+		`If you are attempting to use a Tor client, please refer to the <a href="https://www.torproject.org/">Tor website</a>.`: `Wenn Sie versuchen, einen Tor-Client zu nutzen, besuchen Sie die <a href="https://www.torproject.org/">Tor-Website</a>.`,
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %q, got %q", expected, entries)
+	}
+
+	if _, err := ParsePO(strings.NewReader("msgid \"unterminated\n")); err == nil {
+		t.Error("Expected a bad string to be rejected")
+	}
+
+	// our own template has to parse for the check to run at all
+	f, err := os.Open("check.pot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if entries, err = ParsePO(f); err != nil || len(entries) == 0 {
+		t.Errorf("Expected check.pot to parse, got %d entries: %v", len(entries), err)
+	}
+}
+
+func TestTranslationCoverage(t *testing.T) {
+	fsys := fstest.MapFS{
+		"check.pot":  {Data: []byte(testTemplate)},
+		"data/langs": {Data: []byte(`[{"code": "de", "name": "German"}, {"code": "fr", "name": "French"}, {"code": "it", "name": "Italian"}, {"code": "nl", "name": "Dutch"}, {"code": "ja", "name": "Japanese"}]`)},
+		// full
+		"locale/de/torcheck.po": {Data: []byte(`msgid "Congratulations. This browser is configured to use Tor."
+msgstr "Glückwunsch. Dieser Browser ist für die Nutzung von Tor konfiguriert."
+
+msgid "If you are attempting to use a Tor client, please refer to the <a href=\"https://www.torproject.org/\">Tor website</a>."
+msgstr "Wenn Sie versuchen, einen Tor-Client zu nutzen, besuchen Sie die <a href=\"https://www.torproject.org/\">Tor-Website</a>."
+
+msgid "One exit"
+msgid_plural "%d exits"
+msgstr[0] "Ein Ausgang"
+msgstr[1] "%d Ausgänge"
+
+msgid "Volunteer"
+msgstr "Freiwillige"
+`)},
+		// half
+		"locale/fr/torcheck.po": {Data: []byte(`msgid "Congratulations. This browser is configured to use Tor."
+msgstr ""
+
+msgid "If you are attempting to use a Tor client, please refer to the <a href=\"https://www.torproject.org/\">Tor website</a>."
+msgstr ""
+
+msgid "Volunteer"
+msgstr "Bénévole"
+
+msgid "One exit"
+msgid_plural "%d exits"
+msgstr[0] "Une sortie"
+msgstr[1] "%d sorties"
+`)},
+		// full, but synced before "One exit" was added
+		"locale/it/torcheck.po": {Data: []byte(`msgid "Congratulations. This browser is configured to use Tor."
+msgstr "Congratulazioni. Questo browser è configurato per usare Tor."
+
+msgid "If you are attempting to use a Tor client, please refer to the <a href=\"https://www.torproject.org/\">Tor website</a>."
+msgstr "Se stai cercando di usare un client Tor, visita il <a href=\"https://www.torproject.org/\">sito di Tor</a>."
+
+msgid "Volunteer"
+msgstr "Volontari"
+`)},
+		// empty
+		"locale/nl/torcheck.po": {Data: []byte(testTemplate)},
+		// missing
+		"locale/ja/LC_MESSAGES/check.mo": {Data: []byte{}},
+	}
+	webLocales, err := FetchTranslationLocales(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved float64) { MinCoverage = saved }(MinCoverage)
+
+	cases := []struct {
+		min      float64
+		expected []string
+	}{
+		{1, []string{"de", "en_US", "it"}},
+		{0.5, []string{"de", "en_US", "fr", "it"}},
+		{0, []string{"de", "en_US", "fr", "it", "nl"}},
+	}
+	for _, c := range cases {
+		MinCoverage = c.min
+		locales, err := GetInstalledLocales(fsys, webLocales, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var codes []string
+		for code := range locales {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		if !reflect.DeepEqual(codes, c.expected) {
+			t.Errorf("At %.0f%%: expected %v, got %v", c.min*100, c.expected, codes)
+		}
+	}
+}
+
+func TestLocaleCache(t *testing.T) {
+	fsys := fstest.MapFS{}
+	for name, f := range testFiles {
+		fsys[name] = f
+	}
+	fsys["data/langs"] = &fstest.MapFile{Data: []byte(`[{"code": "de", "name": "German"}, {"code": "fr", "name": "French"}]`)}
+
+	now := time.Now()
+	cache := NewLocaleCache(fsys, time.Minute)
+	cache.now = func() time.Time { return now }
+	if _, ok := cache.Get()["fr"]; ok {
+		t.Fatal("Expected no fr before it is installed")
+	}
+
+	fsys["locale/fr/torcheck.po"] = &fstest.MapFile{Data: []byte{}}
+	now = now.Add(59 * time.Second)
+	if _, ok := cache.Get()["fr"]; ok {
+		t.Error("Expected the cached list until it expires")
+	}
+	now = now.Add(time.Second)
+	if _, ok := cache.Get()["fr"]; ok {
+		t.Error("Expected the expired list while it is rescanned")
+	}
+	if !eventually(func() bool { _, ok := cache.Get()["fr"]; return ok }) {
+		t.Error("Expected fr once the list expires")
+	}
+
+	delete(fsys, "locale/fr/torcheck.po")
+	if _, ok := cache.Refresh()["fr"]; ok {
+		t.Error("Expected Refresh to rescan immediately")
+	}
+
+	var none *LocaleCache
+	if none.Get() != nil {
+		t.Error("Expected a nil cache to have no locales")
+	}
+}
+
+// eventually polls ok for up to a second
+func eventually(ok func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if ok() {
+			return true
+		}
+	}
+	return ok()
+}
+
+// gatedFS holds up opening data/langs, the start of every scan, until
+// open is closed
+type gatedFS struct {
+	fs.FS
+	open  chan struct{}
+	scans int32
+}
+
+func (g *gatedFS) Open(name string) (fs.File, error) {
+	if name == "data/langs" {
+		atomic.AddInt32(&g.scans, 1)
+		<-g.open
+	}
+	return g.FS.Open(name)
+}
+
+func TestLocaleCacheStale(t *testing.T) {
+	fsys := &gatedFS{FS: testFiles, open: make(chan struct{})}
+	now := time.Now()
+	cache := NewLocaleCache(fsys, time.Minute)
+	cache.now = func() time.Time { return now }
+	close(fsys.open)
+	first := cache.Get()
+	fsys.open = make(chan struct{})
+	now = now.Add(time.Minute)
+
+	// a slow rescan doesn't hold up anyone
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 16; i++ {
+			if !reflect.DeepEqual(cache.Get(), first) {
+				done <- false
+				return
+			}
+		}
+		done <- true
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Expected the old locales while rescanning")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Get not to wait for the rescan")
+	}
+	close(fsys.open)
+	if !eventually(func() bool {
+		cache.mu.RLock()
+		defer cache.mu.RUnlock()
+		return !cache.refreshing
+	}) {
+		t.Fatal("Expected the rescan to finish")
+	}
+	if n := atomic.LoadInt32(&fsys.scans); n != 2 {
+		t.Errorf("Expected one rescan for all the expired Gets, got %d scans", n)
+	}
+}
+
+func TestCompileTemplateFS(t *testing.T) {
+	for name, fsys := range map[string]fs.FS{"embedded": testFiles, "disk": onDisk(t, testFiles)} {
+		domain, err := NewDomain(fsys, "check")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		l, err := NewConfigFS(fsys).CompileTemplate(domain, "index.html")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		buf := new(bytes.Buffer)
+		if err := l.ExecuteTemplate(buf, "index.html", Page{IP: "1.2.3.4"}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if buf.String() != "<title>1.2.3.4</title>" {
+			t.Errorf("%s: unexpected render %q", name, buf.String())
+		}
+	}
+}
+
+func TestNullDomain(t *testing.T) {
+	broken := fstest.MapFS{"locale/de/LC_MESSAGES/check.mo": {Data: []byte("not a catalog")}}
+	if _, err := NewDomain(broken, "check"); err == nil {
+		t.Error("Expected a malformed catalog to fail loading")
+	}
+
+	text := "Sorry. You are not using Tor."
+	if got := NullDomain().GetText("de", text); got != text {
+		t.Errorf("Expected %q, got %q", text, got)
+	}
+	getText := FuncMap(nil)["GetText"].(func(string, string) string)
+	if got := getText("de", text); got != text {
+		t.Errorf("Expected %q from a nil domain, got %q", text, got)
+	}
+}
+
+func TestRedactIP(t *testing.T) {
+	cases := []struct {
+		ip       string
+		level    Redaction
+		expected string
+	}{
+		{"91.121.43.80", RedactNone, "91.121.43.80"},
+		{"91.121.43.80", RedactPartial, "91.121.43.0"},
+		{"91.121.43.80", RedactFull, ""},
+		{"2001:db8:1234:5678::1", RedactNone, "2001:db8:1234:5678::1"},
+		{"2001:db8:1234:5678::1", RedactPartial, "2001:db8:1234::"},
+		{"2001:db8:1234:5678::1", RedactFull, ""},
+		{"bogus", RedactPartial, ""},
+	}
+	for _, c := range cases {
+		if got := RedactIP(c.ip, c.level); got != c.expected {
+			t.Errorf("RedactIP(%q, %d) = %q, expected %q", c.ip, c.level, got, c.expected)
+		}
+	}
+
+	for _, level := range []string{"none", "partial", "full"} {
+		if _, err := ParseRedaction(level); err != nil {
+			t.Errorf("Expected %q to be a valid level: %v", level, err)
+		}
+	}
+	if _, err := ParseRedaction("some"); err == nil {
+		t.Error("Expected an unknown level to be rejected")
+	}
+}
+
+var ScannerAgents = map[string]bool{
+	"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)":        true,
+	"Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)":         true,
+	"Mozilla/5.0 (compatible; YandexSpider/3.0; +http://yandex.com/bots)":             true,
+	"Mozilla/5.0 (compatible; Nmap Scripting Engine; https://nmap.org/book/nse.html)": true,
+	"masscan/1.3 (https://github.com/robertdavidgraham/masscan)":                      true,
+	"Mozilla/5.0 zgrab/0.x":  true,
+	"python-requests/2.31.0": true,
+	"Go-http-client/1.1":     true,
+	"":                       true,
+	"curl/8.4.0":             false,
+	"Mozilla/5.0 (Windows NT 10.0; rv:115.0) Gecko/20100101 Firefox/115.0":                             false,
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_8_4) AppleWebKit/537.36 (KHTML, like Gecko) Safari/537": false,
+}
+
+func TestLikelyScanner(t *testing.T) {
+	for ua, expected := range ScannerAgents {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", ua)
+		r.Header.Set("Accept", "*/*")
+		if LikelyScanner(r) != expected {
+			t.Errorf("Expected \"%s\" to be: %t", ua, expected)
+		}
+	}
+
+	// browsers always send Accept
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; rv:115.0) Gecko/20100101 Firefox/115.0")
+	if !LikelyScanner(r) {
+		t.Error("Expected a request without Accept to look like a scanner")
+	}
+
+	patterns, err := LoadUserAgents(strings.NewReader("^MyProbe/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(saved []*regexp.Regexp) { ScannerUserAgents = saved }(ScannerUserAgents)
+	ScannerUserAgents = append(ScannerUserAgents, patterns...)
+	r.Header.Set("User-Agent", "MyProbe/1.0")
+	r.Header.Set("Accept", "*/*")
+	if !LikelyScanner(r) {
+		t.Error("Expected a configured signature to match")
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	locales := map[string]string{"en_US": "English", "fr": "Français", "de": "Deutsch", "pt_BR": "Português brasileiro"}
+	cases := []struct {
+		query    string
+		header   string
+		expected string
+	}{
+		{"", "", "en_US"},
+		{"?lang=de", "fr", "de"},
+		{"", "fr", "fr"},
+		{"", "fr;q=0.9, de;q=0.8", "fr"},
+		{"", "de;q=0.8, fr;q=0.9", "fr"},
+		{"", "ja, de;q=0.5", "de"},
+		{"", "fr-CA, de;q=0.5", "fr"},
+		{"", "pt-br", "pt_BR"},
+		{"", "en-US,en;q=0.9", "en_US"},
+		{"", "ja, zh;q=0.8", "en_US"},
+		{"", "fr;q=0, de;q=0.1", "de"},
+		{"", "fr;q=bogus, de;q=0.1", "de"},
+		{"", "fr;q=2, de;q=0.1", "de"},
+		{"", "*, de;q=0.1", "de"},
+		{"", ";;,,;q=", "en_US"},
+		{"?lang=pt", "", "pt_BR"},
+		{"?lang=xx", "de", "de"},
+		{"", "pt, de;q=0.5", "pt_BR"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/"+c.query, nil)
+		if len(c.header) > 0 {
+			r.Header.Set("Accept-Language", c.header)
+		}
+		if lang := NegotiateLanguage(r, locales); lang != c.expected {
+			t.Errorf("NegotiateLanguage(%q, Accept-Language: %q) = %q, expected %q", c.query, c.header, lang, c.expected)
+		}
+	}
+}
+
+func TestLangCookie(t *testing.T) {
+	locales := map[string]string{"en_US": "English", "fr": "Français", "de": "Deutsch"}
+	cases := []struct {
+		query    string
+		cookie   string
+		header   string
+		expected string
+	}{
+		{"?lang=de", "fr", "fr", "de"},
+		{"", "fr", "de", "fr"},
+		{"?lang=xx", "fr", "de", "fr"},
+		{"", "", "de", "de"},
+		{"", "ja", "de", "de"},
+		{"", "ja", "", "en_US"},
+		{"", "", "", "en_US"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/"+c.query, nil)
+		if len(c.cookie) > 0 {
+			r.AddCookie(&http.Cookie{Name: LangCookie, Value: c.cookie})
+		}
+		if len(c.header) > 0 {
+			r.Header.Set("Accept-Language", c.header)
+		}
+		if lang := NegotiateLanguage(r, locales); lang != c.expected {
+			t.Errorf("NegotiateLanguage(%q, cookie %q, Accept-Language: %q) = %q, expected %q", c.query, c.cookie, c.header, lang, c.expected)
+		}
+	}
+}
+
+func TestLanguagePrecedence(t *testing.T) {
+	locales := map[string]string{"en_US": "English", "fr": "Français", "de": "Deutsch", "pt_BR": "Português brasileiro", "pt_PT": "Português"}
+	cases := []struct {
+		name     string
+		query    string
+		cookie   string
+		header   string
+		expected string
+		source   string
+	}{
+		{"query beats all", "?lang=de", "fr", "pt", "de", "query"},
+		{"cookie beats header", "", "fr", "de", "fr", "cookie"},
+		{"header", "", "", "de, fr", "de", "accept-language"},
+		{"default", "", "", "", "en_US", "default"},
+		{"unknown query falls to cookie", "?lang=ja", "fr", "de", "fr", "cookie"},
+		{"unknown cookie falls to header", "", "ja", "de", "de", "accept-language"},
+		{"nothing installed", "?lang=ja", "ko", "zh", "en_US", "default"},
+		{"regional fallback stays in its tier", "?lang=pt", "", "de", "pt_BR", "query"},
+		{"base language", "", "fr_CA", "de", "fr", "cookie"},
+		{"equal quality keeps header order", "", "", "fr;q=0.5, de;q=0.5", "fr", "accept-language"},
+		{"higher quality wins", "", "", "fr;q=0.4, de;q=0.5", "de", "accept-language"},
+		{"variants pick the first code", "", "", "pt", "pt_BR", "accept-language"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/"+c.query, nil)
+		if len(c.cookie) > 0 {
+			r.AddCookie(&http.Cookie{Name: LangCookie, Value: c.cookie})
+		}
+		if len(c.header) > 0 {
+			r.Header.Set("Accept-Language", c.header)
+		}
+		if lang := NegotiateLanguage(r, locales); lang != c.expected {
+			t.Errorf("%s: got %q, expected %q", c.name, lang, c.expected)
+		}
+		for _, candidate := range LangCandidates(r, locales) {
+			if len(candidate.Matched) > 0 {
+				if candidate.Source != c.source || candidate.Matched != c.expected {
+					t.Errorf("%s: first match %+v, expected %s from %s", c.name, candidate, c.expected, c.source)
+				}
+				break
+			}
+		}
+	}
+}
+
+func TestLangCandidates(t *testing.T) {
+	locales := map[string]string{"en_US": "English", "fr": "Français", "de": "Deutsch"}
+	r := httptest.NewRequest("GET", "/?lang=ja", nil)
+	r.AddCookie(&http.Cookie{Name: LangCookie, Value: "fr"})
+	r.Header.Set("Accept-Language", "de;q=0.5, es, fr-CA;q=0.8")
+	expected := []LangCandidate{
+		{"query", "ja", ""},
+		{"cookie", "fr", "fr"},
+		{"accept-language", "es", ""},
+		{"accept-language", "fr-CA", "fr"},
+		{"accept-language", "de", "de"},
+		{"default", "en_US", "en_US"},
+	}
+	if candidates := LangCandidates(r, locales); !reflect.DeepEqual(candidates, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, candidates)
+	}
+}
+
+func TestResolveLocale(t *testing.T) {
+	locales := map[string]string{"en_GB": "English (UK)", "en_US": "English", "es": "Español", "pt_BR": "Português brasileiro", "pt_PT": "Português", "zh_CN": "简体中文", "zh_TW": "正體中文"}
+	cases := map[string]string{
+		"en":         "en_US",
+		"en-AU":      "en_US",
+		"en-GB":      "en_GB",
+		"zh-Hant":    "zh_TW",
+		"zh-Hant-HK": "zh_TW",
+		"zh-Hans":    "zh_CN",
+		"zh":         "zh_CN",
+		"pt":         "pt_BR",
+		"pt-pt":      "pt_PT",
+		"pt_AO":      "pt_BR",
+		"es_MX":      "es",
+		"es":         "es",
+		"zh_HK":      "zh_CN",
+		"ja":         "en_US",
+		"":           "en_US",
+	}
+	for code, expected := range cases {
+		if lang := ResolveLocale(code, locales); lang != expected {
+			t.Errorf("ResolveLocale(%q) = %q, expected %q", code, lang, expected)
+		}
+	}
+}
+
+// counts how often each file is opened
+type countingFS struct {
+	fs.FS
+	mu     sync.Mutex
+	opened map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.mu.Lock()
+	c.opened[name]++
+	c.mu.Unlock()
+	return c.FS.Open(name)
+}
+
+func TestCompileTemplateConcurrent(t *testing.T) {
+	// how many opens parsing the layout once takes
+	once := &countingFS{FS: testFiles, opened: make(map[string]int)}
+	if _, err := NewConfigFS(once).CompileTemplate(NullDomain(), "index.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := &countingFS{FS: testFiles, opened: make(map[string]int)}
+	c := NewConfigFS(fsys)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.CompileTemplate(NullDomain(), "index.html")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n, x := fsys.opened["public/base.html"], once.opened["public/base.html"]; n != x {
+		t.Errorf("Expected the base layout to be parsed once, opened it %d times rather than %d", n, x)
+	}
+}
+
+func TestCompileTemplateErrors(t *testing.T) {
+	broken := NewConfigFS(fstest.MapFS{
+		"public/base.html":      testFiles["public/base.html"],
+		"public/torbutton.html": testFiles["public/torbutton.html"],
+		"public/broken.html":    {Data: []byte(`{{ define "broken.html" }}{{ .IP `)},
+	})
+	if _, err := broken.CompileTemplate(NullDomain(), "broken.html"); err == nil {
+		t.Error("Expected a malformed page to return an error")
+	}
+	if _, err := broken.CompileTemplate(NullDomain(), "missing.html"); err == nil {
+		t.Error("Expected a missing page to return an error")
+	}
+
+	if _, err := NewConfigFS(fstest.MapFS{}).CompileTemplate(NullDomain(), "index.html"); err == nil {
+		t.Error("Expected a missing base layout to return an error")
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	render := func(c *Config) string {
+		l, err := c.CompileTemplate(NullDomain(), "index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := new(bytes.Buffer)
+		if err := l.ExecuteTemplate(buf, "index.html", Page{IP: "1.2.3.4"}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	edited := []byte(`{{ define "base.html" }}<h1>{{ template "title" . }}</h1>{{ end }}`)
+
+	for dev, expected := range map[bool]string{false: "<title>1.2.3.4</title>", true: "<h1>1.2.3.4</h1>"} {
+		dir := writeFiles(t, testFiles)
+		c := NewConfig(dir)
+		c.DevMode = dev
+		render(c)
+		if err := os.WriteFile(filepath.Join(dir, "public", "base.html"), edited, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := render(c); got != expected {
+			t.Errorf("With DevMode %t expected %q after editing, got %q", dev, expected, got)
+		}
+	}
+}
+
+func TestLoadLocaleNames(t *testing.T) {
+	logs := recordLogs(t)
+
+	names := LoadLocaleNames(os.DirFS("."))
+	if names["ar"] != "العربية" || names["zh_CN"] != "中文简体" {
+		t.Errorf("Expected the shipped names to load as UTF-8, got %q and %q", names["ar"], names["zh_CN"])
+	}
+
+	fsys := fstest.MapFS{"data/locale-names.json": {Data: []byte("{\"de\": \"Deutsch\", \"fr\": \" \", \"xx\": \"\xff\"}")}}
+	if names := LoadLocaleNames(fsys); !reflect.DeepEqual(names, map[string]string{"de": "Deutsch"}) {
+		t.Errorf("Expected only the valid name, got %v", names)
+	}
+	if !logs.has("info: Translated names for: de") || !logs.has("warn: Ignoring invalid translated name") {
+		t.Errorf("Expected the overridden codes to be logged, got %q", logs.entries)
+	}
+
+	for name, fsys := range map[string]fs.FS{
+		"missing":   fstest.MapFS{},
+		"malformed": fstest.MapFS{"data/locale-names.json": {Data: []byte(`{"de": `)}},
+	} {
+		if names := LoadLocaleNames(fsys); len(names) != 0 {
+			t.Errorf("%s: expected no names, got %v", name, names)
+		}
+	}
+}
+
+func TestDir(t *testing.T) {
+	for _, lang := range []string{"ar", "fa", "he", "ur", "fa_IR", "ar-EG"} {
+		if dir := Dir(lang); dir != "rtl" {
+			t.Errorf("Dir(%q) = %q, expected rtl", lang, dir)
+		}
+	}
+	for _, lang := range []string{"en_US", "de", "ja", "pt_BR", "tr", "", "arn"} {
+		if dir := Dir(lang); dir != "ltr" {
+			t.Errorf("Dir(%q) = %q, expected ltr", lang, dir)
+		}
+	}
+
+	tmpl := template.Must(template.New("").Funcs(FuncMap(nil)).Parse(`<html dir="{{ Dir .Lang }}">`))
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, Page{Lang: "he"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `<html dir="rtl">` {
+		t.Errorf("Unexpected render: %s", buf)
+	}
+}
+
+func TestLinkWith(t *testing.T) {
+	cases := []struct {
+		page     Page
+		target   string
+		kv       []string
+		expected string
+	}{
+		{Page{}, "/", nil, "/"},
+		{Page{Lang: "de"}, "/", nil, "/?lang=de"},
+		{Page{Lang: "de"}, "/", []string{"recheck", "abc"}, "/?lang=de&recheck=abc"},
+		{Page{Lang: "de", Small: true}, "/torbulkexitlist", []string{"ip", "1.2.3.4"}, "/torbulkexitlist?ip=1.2.3.4&lang=de&small=1"},
+		{Page{Lang: "de"}, "/?lang=fr", nil, "/?lang=fr"},
+		{Page{Lang: "de"}, "/", []string{"lang", "fr"}, "/?lang=fr"},
+		{Page{Lang: "de"}, "/?port=80&n=16", []string{"port", "443"}, "/?lang=de&n=16&port=443"},
+		{Page{Lang: "de"}, "/?small=1", []string{"small", ""}, "/?lang=de"},
+		{Page{Lang: "pt_BR"}, "/search", []string{"q", "a b&c=d"}, "/search?lang=pt_BR&q=a+b%26c%3Dd"},
+	}
+	for _, c := range cases {
+		link, err := LinkWith(c.page, c.target, c.kv...)
+		if err != nil || link != c.expected {
+			t.Errorf("LinkWith(%+v, %q, %q) = %q, %v; expected %q", c.page, c.target, c.kv, link, err, c.expected)
+		}
+	}
+
+	for _, bad := range [][]string{{"https://example.com/"}, {"//example.com/"}, {"/", "lang"}} {
+		if _, err := LinkWith(Page{}, bad[0], bad[1:]...); err == nil {
+			t.Errorf("Expected LinkWith(%q) to fail", bad)
+		}
+	}
+
+	tmpl := template.Must(template.New("").Funcs(FuncMap(nil)).Parse(`<a href="{{ LinkWith . "/" "recheck" .Nonce }}">`))
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, Page{Lang: "de", Nonce: "x1"}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `<a href="/?lang=de&amp;recheck=x1">` {
+		t.Errorf("Unexpected render: %s", buf)
+	}
+}
+
+func TestNGetText(t *testing.T) {
+	relays := func(forms ...string) *gettext.Catalog {
+		return &gettext.Catalog{
+			Strings: map[string]*gettext.Translation{
+				"%d relay": {Plural: "%d relays", Translation: forms},
+			},
+			PluralFormula: gettext.GermanicPluralFormula,
+		}
+	}
+	domain := &gettext.Domain{Languages: map[string]*gettext.Catalog{
+		"pl": relays("przekaźnik", "przekaźniki", "przekaźników"),
+		"ru": relays("ретранслятор", "ретранслятора", "ретрансляторов"),
+		"fr": relays("relais", "relais (pluriel)"),
+		"ro": relays("releu", "relee", "de relee"),
+		"ja": relays("リレー"),
+	}}
+	SetPluralForms(domain)
+	nGetText := FuncMap(domain)["NGetText"].(func(string, string, string, int) string)
+
+	cases := []struct {
+		lang     string
+		n        int
+		expected string
+	}{
+		{"pl", 1, "przekaźnik"},
+		{"pl", 2, "przekaźniki"},
+		{"pl", 4, "przekaźniki"},
+		{"pl", 5, "przekaźników"},
+		{"pl", 12, "przekaźników"},
+		{"pl", 21, "przekaźników"},
+		{"pl", 22, "przekaźniki"},
+		{"ru", 1, "ретранслятор"},
+		{"ru", 3, "ретранслятора"},
+		{"ru", 11, "ретрансляторов"},
+		{"ru", 21, "ретранслятор"},
+		{"ru", 25, "ретрансляторов"},
+		{"ro", 1, "releu"},
+		{"ro", 0, "relee"},
+		{"ro", 19, "relee"},
+		{"ro", 20, "de relee"},
+		{"ro", 101, "relee"},
+		{"ro", 120, "de relee"},
+		{"fr", 0, "relais"},
+		{"fr", 2, "relais (pluriel)"},
+		{"ja", 5, "リレー"},
+		// missing translations fall back to English
+		{"de", 1, "%d relay"},
+		{"de", 5, "%d relays"},
+	}
+	for _, c := range cases {
+		if got := nGetText(c.lang, "%d relay", "%d relays", c.n); got != c.expected {
+			t.Errorf("NGetText(%s, %d) = %q, expected %q", c.lang, c.n, got, c.expected)
+		}
+	}
+
+	if PluralFormula("pt_BR")(0) != 0 || PluralFormula("pt")(0) != 1 {
+		t.Error("Expected pt_BR to use its own rule rather than pt's")
+	}
+}